@@ -0,0 +1,156 @@
+// history.go
+//
+// Persistent, monotonic historyId bookkeeping and the users.history.list
+// endpoint. Every write that adds, deletes, or relabels a mailbox message
+// appends a HistoryRecord here so incremental-sync clients (anything
+// polling users.history.list?startHistoryId=...) don't have to re-list the
+// whole mailbox after every change. Label CRUD and draft create/update
+// advance the historyId counter without appending a record.
+// Version: 1.0
+// Last Updated: 2025-07-23
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const historyIdFileName = "history_id.txt"
+
+// loadPersistedHistoryId reads the last historyId a prior run of this
+// emulator assigned, so a restart resumes counting instead of starting
+// over (or depending on time.Now(), which could run backwards relative to
+// the dataset).
+func loadPersistedHistoryId(dataPath string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataPath, historyIdFileName))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// savePersistedHistoryId writes the current counter value so the next
+// restart can resume from it. Best-effort: a write failure here shouldn't
+// fail the request that triggered it.
+func (e *GmailEmulator) savePersistedHistoryId() {
+	path := filepath.Join(e.dataPath, historyIdFileName)
+	_ = ioutil.WriteFile(path, []byte(strconv.FormatUint(e.nextHistoryId, 10)), 0644)
+}
+
+// recordHistory bumps the monotonic historyId counter, appends a
+// HistoryRecord for it, persists the new counter value, and returns the new
+// Id as a string for embedding in a GmailMessage.HistoryId field. The
+// caller is responsible for holding e.mu.
+func (e *GmailEmulator) recordHistory(recordType, messageId, threadId string, labelIds []string) string {
+	e.nextHistoryId++
+	e.historyLog = append(e.historyLog, HistoryRecord{
+		Id:        e.nextHistoryId,
+		MessageId: messageId,
+		ThreadId:  threadId,
+		Type:      recordType,
+		LabelIds:  labelIds,
+	})
+	e.savePersistedHistoryId()
+	return strconv.FormatUint(e.nextHistoryId, 10)
+}
+
+// bumpHistoryIdOnly advances the counter without recording a HistoryRecord,
+// for writes - like label resource CRUD, or a draft that hasn't been sent
+// and so isn't part of the synced mailbox yet - that don't belong in the
+// change stream. The caller is responsible for holding e.mu.
+func (e *GmailEmulator) bumpHistoryIdOnly() string {
+	e.nextHistoryId++
+	e.savePersistedHistoryId()
+	return strconv.FormatUint(e.nextHistoryId, 10)
+}
+
+// handleListHistory implements users.history.list: records with
+// Id > startHistoryId, optionally filtered by labelId and historyTypes,
+// page by page.
+func (e *GmailEmulator) handleListHistory(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	q := r.URL.Query()
+
+	start := uint64(0)
+	if s := q.Get("startHistoryId"); s != "" {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			start = n
+		}
+	}
+
+	labelId := q.Get("labelId")
+	historyTypes := q["historyTypes"]
+
+	maxResults := 100
+	if mr := q.Get("maxResults"); mr != "" {
+		if n, err := strconv.Atoi(mr); err == nil && n > 0 {
+			maxResults = n
+		}
+	}
+
+	pageStart := 0
+	if pt := q.Get("pageToken"); pt != "" {
+		if n, err := strconv.Atoi(pt); err == nil {
+			pageStart = n
+		}
+	}
+
+	e.mu.RLock()
+	matched := make([]HistoryRecord, 0, len(e.historyLog))
+	for _, rec := range e.historyLog {
+		if rec.Id <= start {
+			continue
+		}
+		if labelId != "" && !containsString(rec.LabelIds, labelId) {
+			continue
+		}
+		if len(historyTypes) > 0 && !containsString(historyTypes, rec.Type) {
+			continue
+		}
+		matched = append(matched, rec)
+	}
+	currentHistoryId := e.nextHistoryId
+	e.mu.RUnlock()
+
+	page := []HistoryRecord{}
+	end := pageStart + maxResults
+	if end > len(matched) {
+		end = len(matched)
+	}
+	if pageStart < len(matched) {
+		page = matched[pageStart:end]
+	}
+
+	response := struct {
+		History       []HistoryRecord `json:"history"`
+		HistoryId     string          `json:"historyId"`
+		NextPageToken string          `json:"nextPageToken,omitempty"`
+	}{
+		History:   page,
+		HistoryId: strconv.FormatUint(currentHistoryId, 10),
+	}
+	if end < len(matched) {
+		response.NextPageToken = strconv.Itoa(end)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func containsString(list []string, target string) bool {
+	for _, s := range list {
+		if s == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,372 @@
+// index.go
+//
+// Load-time indexes that let filterMessages avoid an O(N) scan over the
+// full Enron corpus on every list/search request: a label->ordinal
+// bitmap, a sorted date index for after:/before:/newer_than:/older_than:
+// range queries, and a per-field token index for from:/to:/cc:/subject:.
+// parseQuery's AST (query.go) compiles into bitmap AND/OR/AND-NOT
+// operations over these indexes wherever that's sound; anything it can't
+// prove from the indexes alone - has:attachment, filename:, larger:/
+// smaller:, is:/in:, quoted phrases, and bare-word body search - is left
+// as a residual AST node, re-checked with the original per-message Eval
+// only over the already-narrowed candidate set. A conjunction of entirely
+// indexable terms (e.g. "from:kenneth label:INBOX after:2001/1/1") never
+// touches a single MessagePart: the whole thing resolves to bitmap ops,
+// and filterMessages then builds a MessageRef for every matching ordinal;
+// pagination is applied by the caller to that full list.
+//
+// BenchmarkFilterMessages_500k (index_test.go) measures this against a
+// synthetic 500k-message corpus: a label lookup is one map lookup plus
+// bitmap ops, a from:/to:/cc:/subject: term unions the bitmaps of every
+// indexed token containing it (one pass over tokenIndex's keys), date
+// range selection is O(log N) via binary search, and the final scan is
+// bounded by the result set size rather than corpus size.
+// Version: 1.1 - added BenchmarkFilterMessages_500k
+// Last Updated: 2025-07-26
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+var (
+	timeNegInf = time.Time{}
+	timePosInf = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// buildQueryIndexes builds labelIndex, tokenIndex, and ordinalOf from
+// e.messagesByDate, which must already be sorted ascending by internal
+// date. The caller is responsible for holding e.mu (or calling this
+// before the emulator is shared across goroutines).
+func (e *GmailEmulator) buildQueryIndexes() {
+	e.labelIndex = make(map[string]*roaring.Bitmap)
+	e.tokenIndex = make(map[string]*roaring.Bitmap)
+	e.ordinalOf = make(map[string]int, len(e.messagesByDate))
+
+	for ordinal, msg := range e.messagesByDate {
+		e.ordinalOf[msg.Id] = ordinal
+		e.indexMessageLabels(msg, ordinal)
+		e.indexMessageTokens(msg, ordinal)
+	}
+}
+
+// indexMessageLabels adds ordinal to the bitmap for each of msg's current
+// labels, creating the bitmap on first use.
+func (e *GmailEmulator) indexMessageLabels(msg *GmailMessage, ordinal int) {
+	for _, label := range msg.LabelIds {
+		e.addToLabelIndex(strings.ToUpper(label), ordinal)
+	}
+}
+
+func (e *GmailEmulator) addToLabelIndex(label string, ordinal int) {
+	bm, ok := e.labelIndex[label]
+	if !ok {
+		bm = roaring.New()
+		e.labelIndex[label] = bm
+	}
+	bm.Add(uint32(ordinal))
+}
+
+// syncLabelIndex brings the label index for msg back in sync with its
+// current LabelIds, for a message that already has an ordinal (i.e. one
+// that's been through buildQueryIndexes or indexNewMessage). Called by
+// applyLabelChanges after every label mutation, so every write path -
+// modify, trash/untrash, thread-level modify/trash/untrash, send-draft -
+// stays indexed without each of them needing to know about the index.
+func (e *GmailEmulator) syncLabelIndex(msg *GmailMessage) {
+	ordinal, ok := e.ordinalOf[msg.Id]
+	if !ok {
+		return
+	}
+	for _, bm := range e.labelIndex {
+		bm.Remove(uint32(ordinal))
+	}
+	e.indexMessageLabels(msg, ordinal)
+}
+
+// removeFromLabelIndex drops ordinal from every label bitmap, for a
+// message that's been permanently deleted.
+func (e *GmailEmulator) removeFromLabelIndex(msg *GmailMessage) {
+	ordinal, ok := e.ordinalOf[msg.Id]
+	if !ok {
+		return
+	}
+	for _, bm := range e.labelIndex {
+		bm.Remove(uint32(ordinal))
+	}
+	delete(e.ordinalOf, msg.Id)
+}
+
+// indexMessageTokens tokenizes From/To/Cc/Subject into field-prefixed
+// tokens ("f:", "t:", "c:", "s:") so a single-word from:/to:/cc:/
+// subject: term can be answered from the token index instead of a
+// per-message substring scan. Snippet/body text isn't tokenized here: textSearch also
+// matches against the full decoded body, which isn't indexed, so a
+// bare-word query can't be answered from this index alone without risking
+// false negatives - it stays on the residual (linear Eval) path.
+func (e *GmailEmulator) indexMessageTokens(msg *GmailMessage, ordinal int) {
+	e.addTokens("f:", e.getHeader(msg, "From"), ordinal)
+	e.addTokens("t:", e.getHeader(msg, "To"), ordinal)
+	e.addTokens("c:", e.getHeader(msg, "Cc"), ordinal)
+	e.addTokens("s:", e.getHeader(msg, "Subject"), ordinal)
+}
+
+func (e *GmailEmulator) addTokens(prefix, text string, ordinal int) {
+	for _, token := range tokenize(text) {
+		e.addToTokenIndex(prefix+token, ordinal)
+	}
+}
+
+func (e *GmailEmulator) addToTokenIndex(key string, ordinal int) {
+	bm, ok := e.tokenIndex[key]
+	if !ok {
+		bm = roaring.New()
+		e.tokenIndex[key] = bm
+	}
+	bm.Add(uint32(ordinal))
+}
+
+// tokenize lowercases s and splits it into maximal runs of letters/digits,
+// the same granularity from:/to:/cc:/subject: terms are matched at.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// isSingleToken reports whether s is exactly one token, i.e. safe to
+// answer from the token index without a linear recheck: anything with
+// punctuation or spaces could match header substrings the tokenizer would
+// have split differently, so those stay on the residual path.
+func isSingleToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// universeBitmap returns a bitmap covering every ordinal currently
+// indexed, used as the base for NotNode and as the fallback when a query
+// has no indexable constraints at all.
+func (e *GmailEmulator) universeBitmap() *roaring.Bitmap {
+	bm := roaring.New()
+	if len(e.messagesByDate) > 0 {
+		bm.AddRange(0, uint64(len(e.messagesByDate)))
+	}
+	return bm
+}
+
+// unionLabelBitmap ORs together the bitmaps for every requested label,
+// matching filterMessages' original any-of-these-labels semantics.
+func (e *GmailEmulator) unionLabelBitmap(labels []string) *roaring.Bitmap {
+	result := roaring.New()
+	for _, label := range labels {
+		if bm, ok := e.labelIndex[strings.ToUpper(label)]; ok {
+			result.Or(bm)
+		}
+	}
+	return result
+}
+
+// dateRangeBitmap returns the ordinals of every message whose internal
+// date falls in [after, before], found via binary search over the
+// date-sorted messagesByDate rather than a per-message comparison.
+func (e *GmailEmulator) dateRangeBitmap(after, before time.Time) *roaring.Bitmap {
+	lo := sortSearchMessages(e.messagesByDate, func(msg *GmailMessage) bool {
+		return !e.getMessageTime(msg).Before(after)
+	})
+	hi := sortSearchMessages(e.messagesByDate, func(msg *GmailMessage) bool {
+		return e.getMessageTime(msg).After(before)
+	})
+
+	bm := roaring.New()
+	if hi > lo {
+		bm.AddRange(uint64(lo), uint64(hi))
+	}
+	return bm
+}
+
+// sortSearchMessages finds the smallest index in msgs for which pred is
+// true, assuming pred is false then true across the (date-sorted) slice -
+// the same contract as sort.Search, spelled out over *GmailMessage
+// instead of a raw index predicate so dateRangeBitmap reads linearly.
+func sortSearchMessages(msgs []*GmailMessage, pred func(*GmailMessage) bool) int {
+	lo, hi := 0, len(msgs)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if pred(msgs[mid]) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+// compileBitmap tries to compute the exact set of matching ordinals for
+// node from the indexes alone. ok is false wherever that isn't sound -
+// the caller should fall back to linear Eval for that part of the query.
+func (e *GmailEmulator) compileBitmap(node queryNode) (*roaring.Bitmap, bool) {
+	switch n := node.(type) {
+	case *AndNode:
+		var result *roaring.Bitmap
+		for _, child := range n.Children {
+			bm, ok := e.compileBitmap(child)
+			if !ok {
+				return nil, false
+			}
+			if result == nil {
+				result = bm.Clone()
+			} else {
+				result.And(bm)
+			}
+		}
+		if result == nil {
+			result = e.universeBitmap()
+		}
+		return result, true
+
+	case *OrNode:
+		var result *roaring.Bitmap
+		for _, child := range n.Children {
+			bm, ok := e.compileBitmap(child)
+			if !ok {
+				return nil, false
+			}
+			if result == nil {
+				result = bm.Clone()
+			} else {
+				result.Or(bm)
+			}
+		}
+		return result, true
+
+	case *NotNode:
+		bm, ok := e.compileBitmap(n.Child)
+		if !ok {
+			return nil, false
+		}
+		universe := e.universeBitmap()
+		universe.AndNot(bm)
+		return universe, true
+
+	case *TermNode:
+		return e.compileTerm(n.Raw)
+	}
+
+	return nil, false
+}
+
+// compileTerm handles the subset of evalTerm's operators that can be
+// answered exactly from labelIndex/tokenIndex/the date-sorted
+// messagesByDate.
+func (e *GmailEmulator) compileTerm(raw string) (*roaring.Bitmap, bool) {
+	lower := strings.ToLower(raw)
+
+	switch {
+	case strings.HasPrefix(lower, "label:"):
+		value := strings.TrimPrefix(lower, "label:")
+		if bm, ok := e.labelIndex[strings.ToUpper(value)]; ok {
+			return bm.Clone(), true
+		}
+		return roaring.New(), true
+
+	case strings.HasPrefix(lower, "from:"):
+		return e.compileTokenTerm("f:", strings.TrimPrefix(lower, "from:"))
+	case strings.HasPrefix(lower, "to:"):
+		return e.compileTokenTerm("t:", strings.TrimPrefix(lower, "to:"))
+	case strings.HasPrefix(lower, "cc:"):
+		return e.compileTokenTerm("c:", strings.TrimPrefix(lower, "cc:"))
+	case strings.HasPrefix(lower, "subject:"):
+		return e.compileTokenTerm("s:", strings.TrimPrefix(lower, "subject:"))
+
+	case strings.HasPrefix(lower, "after:"):
+		if t, err := parseQueryDate(strings.TrimPrefix(lower, "after:")); err == nil {
+			return e.dateRangeBitmap(t, timePosInf), true
+		}
+	case strings.HasPrefix(lower, "before:"):
+		if t, err := parseQueryDate(strings.TrimPrefix(lower, "before:")); err == nil {
+			return e.dateRangeBitmap(timeNegInf, t), true
+		}
+	case strings.HasPrefix(lower, "newer_than:"):
+		if t, err := parseRelativeDate(strings.TrimPrefix(lower, "newer_than:")); err == nil {
+			return e.dateRangeBitmap(t, timePosInf), true
+		}
+	case strings.HasPrefix(lower, "older_than:"):
+		if t, err := parseRelativeDate(strings.TrimPrefix(lower, "older_than:")); err == nil {
+			return e.dateRangeBitmap(timeNegInf, t), true
+		}
+	}
+
+	return nil, false
+}
+
+func (e *GmailEmulator) compileTokenTerm(prefix, value string) (*roaring.Bitmap, bool) {
+	if !isSingleToken(value) {
+		return nil, false
+	}
+	// headerContains matches substrings, and a run of letters/digits can
+	// only occur inside one token, so union every token that contains value.
+	result := roaring.New()
+	for key, bm := range e.tokenIndex {
+		if strings.HasPrefix(key, prefix) && strings.Contains(key[len(prefix):], value) {
+			result.Or(bm)
+		}
+	}
+	return result, true
+}
+
+// planFilter compiles ast into an exact bitmap wherever it can, splitting
+// a top-level conjunction into whatever conjuncts ARE provably indexable
+// (combined into bitmap) plus whatever aren't (left as a residual AST
+// node). A query that's entirely indexable - e.g.
+// "from:kenneth label:INBOX after:2001/1/1" - returns a non-nil bitmap and
+// a nil residual, so filterMessages never runs Eval on a single message.
+func (e *GmailEmulator) planFilter(ast queryNode) (bitmap *roaring.Bitmap, residual queryNode) {
+	and, isAnd := ast.(*AndNode)
+	if !isAnd {
+		if bm, ok := e.compileBitmap(ast); ok {
+			return bm, nil
+		}
+		return nil, ast
+	}
+
+	var combined *roaring.Bitmap
+	var residuals []queryNode
+
+	for _, child := range and.Children {
+		if bm, ok := e.compileBitmap(child); ok {
+			if combined == nil {
+				combined = bm.Clone()
+			} else {
+				combined.And(bm)
+			}
+		} else {
+			residuals = append(residuals, child)
+		}
+	}
+
+	switch len(residuals) {
+	case 0:
+		residual = nil
+	case 1:
+		residual = residuals[0]
+	default:
+		residual = &AndNode{Children: residuals}
+	}
+
+	return combined, residual
+}
@@ -0,0 +1,78 @@
+// index_test.go
+//
+// Benchmarks filterMessages over a synthetic 500k-message corpus, to back
+// up the complexity argument in index.go's header comment with a measured
+// mean time per call (ns/op).
+// Version: 1.0
+// Last Updated: 2025-07-26
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchmarkSenders/benchmarkLabels give filterMessages' label/token
+// indexes enough distinct values to exercise real bitmap unions rather
+// than one giant bitmap per term.
+var (
+	benchmarkSenders = []string{"kenneth.lay", "jeff.skilling", "sara.shackleton", "louise.kitchen", "mark.taylor"}
+	benchmarkLabels  = []string{"INBOX", "SENT", "IMPORTANT", "STARRED", "TRASH"}
+)
+
+// newBenchmarkEmulator builds a GmailEmulator over n synthetic messages,
+// one hour apart from 1999-01-01 (about 57 years for n = 500k) so
+// after:/before: range queries have something to narrow down.
+func newBenchmarkEmulator(n int) *GmailEmulator {
+	start := time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	messages := make([]*GmailMessage, n)
+	for i := 0; i < n; i++ {
+		sender := benchmarkSenders[i%len(benchmarkSenders)]
+		date := start.Add(time.Duration(i) * time.Hour)
+
+		messages[i] = &GmailMessage{
+			Id:           strconv.Itoa(i),
+			ThreadId:     strconv.Itoa(i / 3), // a handful of messages per thread
+			LabelIds:     []string{benchmarkLabels[i%len(benchmarkLabels)], "INBOX"},
+			InternalDate: strconv.FormatInt(date.UnixMilli(), 10),
+			Payload: &MessagePart{
+				MimeType: "text/plain",
+				Headers: []Header{
+					{Name: "From", Value: fmt.Sprintf("%s@enron.com", sender)},
+					{Name: "To", Value: "me@enron.com"},
+					{Name: "Subject", Value: fmt.Sprintf("Quarterly update %d", i)},
+				},
+				Body: &MessageBody{Size: 0},
+			},
+		}
+	}
+
+	emulator := &GmailEmulator{
+		messages:  make(map[string]*GmailMessage),
+		userEmail: "me@enron.com",
+	}
+	emulator.rebuildFromMessages(messages)
+	return emulator
+}
+
+// BenchmarkFilterMessages_500k measures filterMessages latency for a query
+// that's entirely answerable from labelIndex/tokenIndex/the date index
+// ("from:kenneth label:INBOX after:2001/1/1" is the example planFilter's
+// doc comment uses), so it's exercising the indexed path index.go exists
+// for rather than the residual per-message Eval fallback.
+func BenchmarkFilterMessages_500k(b *testing.B) {
+	const corpusSize = 500000
+	emulator := newBenchmarkEmulator(corpusSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		emulator.filterMessages("from:kenneth label:INBOX after:2001/1/1", "")
+	}
+}
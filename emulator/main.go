@@ -12,26 +12,35 @@
 //
 // Gmail API Emulator for Docker deployment
 // Serves transformed Enron data as Gmail API
-// Version: 2.3 - Added endpoint to list all email addresses in dataset
-// Last Updated: 2025-07-13
+// Version: 2.11 - Bitmap-indexed filterMessages (index.go), replacing the
+// per-request O(N) scan over messagesByDate
+// Last Updated: 2025-07-25
 
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/carson-sweet/gmail_emulator/imapserver"
+	"github.com/carson-sweet/gmail_emulator/smtpserver"
 )
 
 // Gmail API structures
@@ -56,8 +65,9 @@ type MessagePart struct {
 }
 
 type MessageBody struct {
-	Size int    `json:"size"`
-	Data string `json:"data"`
+	Size         int    `json:"size"`
+	Data         string `json:"data,omitempty"`
+	AttachmentId string `json:"attachmentId,omitempty"`
 }
 
 type Header struct {
@@ -101,13 +111,80 @@ type UserInfo struct {
 
 // GmailEmulator serves Gmail API responses
 type GmailEmulator struct {
+	mu             sync.RWMutex
 	messages       map[string]*GmailMessage
 	messageList    []MessageRef
 	messagesByDate []*GmailMessage // Sorted by date
+	threadIndex    map[string][]*GmailMessage
 	userEmail      string
 	dataPath       string
 	requestLog     []RequestLog
 	userList       []UserInfo // New field for caching user list
+	drafts         map[string]*Draft
+	userLabels     map[string]*Label
+	nextHistoryId  uint64
+	historyLog     []HistoryRecord
+	idSeq          uint64
+
+	// lastLoadedModTime is the gmail_messages.json mtime this emulator's
+	// in-memory state was last built from, either at startup or by the
+	// last reloadIfChanged poll (persist.go). It's what lets the SMTP
+	// frontend's writes to the same file become visible here without a
+	// restart. The IMAP bridge keeps its flag changes in its own memory
+	// and does not write the file.
+	lastLoadedModTime time.Time
+
+	// Query-acceleration indexes (index.go), keyed by ordinal = a
+	// message's position in messagesByDate. messagesByDate is append-only
+	// once loaded so ordinals never change under a message, which is what
+	// lets labelIndex/tokenIndex stay valid across writes.
+	labelIndex map[string]*roaring.Bitmap
+	tokenIndex map[string]*roaring.Bitmap
+	ordinalOf  map[string]int
+}
+
+// Draft is the resource returned by users.drafts.{create,get,list,update}.
+type Draft struct {
+	Id      string        `json:"id"`
+	Message *GmailMessage `json:"message"`
+}
+
+// DraftRef is the summary form returned by users.drafts.list.
+type DraftRef struct {
+	Id      string     `json:"id"`
+	Message MessageRef `json:"message"`
+}
+
+// ThreadRef is the summary form returned by users.threads.list
+type ThreadRef struct {
+	Id      string `json:"id"`
+	Snippet string `json:"snippet"`
+}
+
+// Thread is the full form returned by users.threads.get
+type Thread struct {
+	Id        string          `json:"id"`
+	HistoryId string          `json:"historyId"`
+	Messages  []*GmailMessage `json:"messages"`
+}
+
+// History mutation types recorded in historyLog, matching the "type" field
+// of a real Gmail history record.
+const (
+	HistoryMessageAdded   = "messageAdded"
+	HistoryMessageDeleted = "messageDeleted"
+	HistoryLabelAdded     = "labelAdded"
+	HistoryLabelRemoved   = "labelRemoved"
+)
+
+// HistoryRecord is a single entry in the users.history.list change stream:
+// one mutation applied to one message, with a strictly increasing Id.
+type HistoryRecord struct {
+	Id        uint64   `json:"id"`
+	MessageId string   `json:"messageId"`
+	ThreadId  string   `json:"threadId"`
+	Type      string   `json:"type"`
+	LabelIds  []string `json:"labelIds,omitempty"`
 }
 
 type RequestLog struct {
@@ -124,6 +201,8 @@ func NewGmailEmulator(dataPath, userEmail string) (*GmailEmulator, error) {
 		dataPath:   dataPath,
 		requestLog: []RequestLog{},
 		userList:   []UserInfo{},
+		drafts:     make(map[string]*Draft),
+		userLabels: make(map[string]*Label),
 	}
 
 	// Load messages
@@ -138,25 +217,88 @@ func NewGmailEmulator(dataPath, userEmail string) (*GmailEmulator, error) {
 		return nil, fmt.Errorf("unmarshal messages: %w", err)
 	}
 
+	emulator.rebuildFromMessages(messageSlice)
+
+	// ...and past whatever was last persisted to disk, so users.profile's
+	// HistoryId keeps climbing across restarts instead of resetting.
+	if persisted, err := loadPersistedHistoryId(dataPath); err == nil && persisted > emulator.nextHistoryId {
+		emulator.nextHistoryId = persisted
+	}
+
+	if info, err := os.Stat(messagesPath); err == nil {
+		emulator.lastLoadedModTime = info.ModTime()
+	}
+
+	log.Printf("Loaded %d messages from %s", len(emulator.messages), dataPath)
+	log.Printf("Found %d unique email addresses in dataset", len(emulator.userList))
+
+	return emulator, nil
+}
+
+// rebuildFromMessages resets every message-derived field and index from
+// scratch given a freshly loaded or reloaded message slice. It's shared by
+// NewGmailEmulator's startup load and reloadIfChanged's (persist.go)
+// periodic re-read of gmail_messages.json, so both build state the same
+// way. The caller is responsible for holding e.mu (write lock) - or, for
+// NewGmailEmulator, for calling this before the emulator is reachable by
+// any other goroutine.
+func (e *GmailEmulator) rebuildFromMessages(messageSlice []*GmailMessage) {
+	e.messages = make(map[string]*GmailMessage, len(messageSlice))
+	e.messageList = e.messageList[:0]
+
 	// Index messages and build list
 	for _, msg := range messageSlice {
-		emulator.messages[msg.Id] = msg
-		emulator.messageList = append(emulator.messageList, MessageRef{
+		e.messages[msg.Id] = msg
+		e.messageList = append(e.messageList, MessageRef{
 			Id:       msg.Id,
 			ThreadId: msg.ThreadId,
 		})
 	}
 
-	// Sort by date for query filtering
-	emulator.messagesByDate = messageSlice
+	// Sort by date for query filtering - dateRangeBitmap in index.go
+	// binary-searches this slice, so it must actually be sorted rather
+	// than left in load order.
+	e.messagesByDate = messageSlice
+	sort.Slice(e.messagesByDate, func(i, j int) bool {
+		return e.getMessageTime(e.messagesByDate[i]).Before(e.getMessageTime(e.messagesByDate[j]))
+	})
+
+	// Group messages into threads for the users.threads endpoints
+	e.buildThreadIndex()
 
 	// Build user list from messages
-	emulator.buildUserList()
+	e.userList = e.userList[:0] // buildUserList appends, so start empty
+	e.buildUserList()
+
+	// Build the label/token/date indexes filterMessages compiles queries
+	// against, now that messagesByDate's order (= ordinal space) is final
+	// for every message loaded from disk.
+	e.buildQueryIndexes()
+
+	// Seed the write-path historyId counter past whatever the dataset
+	// already assigned, so newly created/modified messages never collide
+	// with historyIds baked in by the transformer.
+	for _, msg := range e.messagesByDate {
+		if id, err := strconv.ParseUint(msg.HistoryId, 10, 64); err == nil && id > e.nextHistoryId {
+			e.nextHistoryId = id
+		}
+	}
+}
 
-	log.Printf("Loaded %d messages from %s", len(emulator.messages), dataPath)
-	log.Printf("Found %d unique email addresses in dataset", len(emulator.userList))
+// buildThreadIndex groups messages by ThreadId, sorted oldest-first, so
+// thread handlers don't have to rescan the whole message set per request.
+func (e *GmailEmulator) buildThreadIndex() {
+	e.threadIndex = make(map[string][]*GmailMessage)
 
-	return emulator, nil
+	for _, msg := range e.messagesByDate {
+		e.threadIndex[msg.ThreadId] = append(e.threadIndex[msg.ThreadId], msg)
+	}
+
+	for _, msgs := range e.threadIndex {
+		sort.Slice(msgs, func(i, j int) bool {
+			return e.getMessageTime(msgs[i]).Before(e.getMessageTime(msgs[j]))
+		})
+	}
 }
 
 // New method to build user list from messages
@@ -329,12 +471,15 @@ func (e *GmailEmulator) handleListUsers(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Filter users
+	e.mu.RLock()
 	filtered := []UserInfo{}
 	for _, user := range e.userList {
 		if typeFilter == "" || user.Type == typeFilter {
 			filtered = append(filtered, user)
 		}
 	}
+	totalCount := len(e.userList)
+	e.mu.RUnlock()
 
 	// Apply limit
 	if limit > 0 && limit < len(filtered) {
@@ -343,7 +488,7 @@ func (e *GmailEmulator) handleListUsers(w http.ResponseWriter, r *http.Request)
 
 	response := map[string]interface{}{
 		"users":      filtered,
-		"totalCount": len(e.userList),
+		"totalCount": totalCount,
 		"metadata": map[string]interface{}{
 			"primaryUser": e.userEmail,
 			"dataPath":    e.dataPath,
@@ -364,31 +509,49 @@ func (e *GmailEmulator) handleProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	e.mu.RLock()
+	messagesTotal := len(e.messages)
+	threadsTotal := e.countThreads()
+	historyId := e.nextHistoryId
+	e.mu.RUnlock()
+
 	profile := UserProfile{
 		EmailAddress:  e.userEmail,
-		MessagesTotal: len(e.messages),
-		ThreadsTotal:  e.countThreads(),
-		HistoryId:     fmt.Sprintf("%d", time.Now().Unix()),
+		MessagesTotal: messagesTotal,
+		ThreadsTotal:  threadsTotal,
+		HistoryId:     strconv.FormatUint(historyId, 10),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(profile)
 }
 
+// systemLabels are the built-in labels every Gmail account has; they can't
+// be created, patched, or deleted through the labels CRUD endpoints.
+var systemLabels = []Label{
+	{Id: "INBOX", Name: "INBOX", Type: "system"},
+	{Id: "SENT", Name: "SENT", Type: "system"},
+	{Id: "DRAFT", Name: "DRAFT", Type: "system"},
+	{Id: "SPAM", Name: "SPAM", Type: "system"},
+	{Id: "TRASH", Name: "TRASH", Type: "system"},
+	{Id: "UNREAD", Name: "UNREAD", Type: "system"},
+	{Id: "IMPORTANT", Name: "IMPORTANT", Type: "system"},
+	{Id: "CATEGORY_PERSONAL", Name: "CATEGORY_PERSONAL", Type: "system"},
+	{Id: "CATEGORY_SOCIAL", Name: "CATEGORY_SOCIAL", Type: "system"},
+	{Id: "CATEGORY_PROMOTIONS", Name: "CATEGORY_PROMOTIONS", Type: "system"},
+	{Id: "CATEGORY_UPDATES", Name: "CATEGORY_UPDATES", Type: "system"},
+}
+
 func (e *GmailEmulator) handleLabels(w http.ResponseWriter, r *http.Request) {
-	labels := []Label{
-		{Id: "INBOX", Name: "INBOX", Type: "system"},
-		{Id: "SENT", Name: "SENT", Type: "system"},
-		{Id: "DRAFT", Name: "DRAFT", Type: "system"},
-		{Id: "SPAM", Name: "SPAM", Type: "system"},
-		{Id: "TRASH", Name: "TRASH", Type: "system"},
-		{Id: "UNREAD", Name: "UNREAD", Type: "system"},
-		{Id: "IMPORTANT", Name: "IMPORTANT", Type: "system"},
-		{Id: "CATEGORY_PERSONAL", Name: "CATEGORY_PERSONAL", Type: "system"},
-		{Id: "CATEGORY_SOCIAL", Name: "CATEGORY_SOCIAL", Type: "system"},
-		{Id: "CATEGORY_PROMOTIONS", Name: "CATEGORY_PROMOTIONS", Type: "system"},
-		{Id: "CATEGORY_UPDATES", Name: "CATEGORY_UPDATES", Type: "system"},
+	labels := append([]Label{}, systemLabels...)
+
+	e.mu.RLock()
+	for _, label := range e.userLabels {
+		labels = append(labels, *label)
 	}
+	e.mu.RUnlock()
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Id < labels[j].Id })
 
 	response := map[string][]Label{"labels": labels}
 
@@ -422,7 +585,9 @@ func (e *GmailEmulator) handleListMessages(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Filter messages
+	e.mu.RLock()
 	filtered := e.filterMessages(q, labelIds)
+	e.mu.RUnlock()
 
 	// Apply pagination
 	end := start + limit
@@ -449,6 +614,10 @@ func (e *GmailEmulator) handleGetMessage(w http.ResponseWriter, r *http.Request)
 
 	messageId := mux.Vars(r)["messageId"]
 	format := r.URL.Query().Get("format")
+	metadataHeaders := r.URL.Query()["metadataHeaders"]
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	msg, ok := e.messages[messageId]
 	if !ok {
@@ -456,23 +625,127 @@ func (e *GmailEmulator) handleGetMessage(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Handle different format requests
-	response := msg
-	if format == "metadata" {
-		// Return without body
+	// Handle different format requests: full (default), metadata, minimal, raw
+	switch format {
+	case "minimal":
+		minimalMsg := *msg
+		minimalMsg.Payload = nil
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&minimalMsg)
+		return
+	case "raw":
+		raw := e.encodeRaw(msg)
+		response := struct {
+			Id       string `json:"id"`
+			ThreadId string `json:"threadId"`
+			Raw      string `json:"raw"`
+		}{Id: msg.Id, ThreadId: msg.ThreadId, Raw: raw}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&response)
+		return
+	case "metadata":
 		metadataMsg := *msg
 		if metadataMsg.Payload != nil {
 			metadataPayload := *metadataMsg.Payload
 			metadataPayload.Body = nil
+			metadataPayload.Parts = nil
+			if len(metadataHeaders) > 0 {
+				metadataPayload.Headers = filterHeaders(metadataPayload.Headers, metadataHeaders)
+			}
 			metadataMsg.Payload = &metadataPayload
 		}
-		response = &metadataMsg
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&metadataMsg)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// filterHeaders keeps only headers whose name appears in wanted, matching
+// the metadataHeaders behavior of format=metadata in the real Gmail API.
+func filterHeaders(headers []Header, wanted []string) []Header {
+	filtered := []Header{}
+	for _, h := range headers {
+		for _, name := range wanted {
+			if strings.EqualFold(h.Name, name) {
+				filtered = append(filtered, h)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// encodeRaw reconstructs an RFC 5322 message from the top-level headers and
+// the top-level part's decoded body, and base64url-encodes it the way
+// format=raw does in the real API. Nested parts of a multipart payload are
+// not included.
+func (e *GmailEmulator) encodeRaw(msg *GmailMessage) string {
+	var b strings.Builder
+
+	if msg.Payload != nil {
+		for _, h := range msg.Payload.Headers {
+			b.WriteString(h.Name + ": " + h.Value + "\r\n")
+		}
+		b.WriteString("\r\n")
+		if msg.Payload.Body != nil {
+			if decoded, err := base64.StdEncoding.DecodeString(msg.Payload.Body.Data); err == nil {
+				b.Write(decoded)
+			}
+		}
+	}
+
+	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString([]byte(b.String()))
+}
+
+func (e *GmailEmulator) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	vars := mux.Vars(r)
+	messageId := vars["messageId"]
+	attachmentId := vars["attachmentId"]
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	msg, ok := e.messages[messageId]
+	if !ok || msg.Payload == nil {
+		http.Error(w, `{"error": {"code": 404, "message": "Message not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	body := findAttachment(msg.Payload, attachmentId)
+	if body == nil {
+		http.Error(w, `{"error": {"code": 404, "message": "Attachment not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		Size int    `json:"size"`
+		Data string `json:"data"`
+	}{Size: body.Size, Data: body.Data}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// findAttachment walks a MessagePart tree looking for the body whose
+// AttachmentId matches, since attachments can be nested under
+// multipart/mixed or multipart/alternative containers.
+func findAttachment(part *MessagePart, attachmentId string) *MessageBody {
+	if part.Body != nil && part.Body.AttachmentId == attachmentId {
+		return part.Body
+	}
+	for i := range part.Parts {
+		if body := findAttachment(&part.Parts[i], attachmentId); body != nil {
+			return body
+		}
+	}
+	return nil
+}
+
 func (e *GmailEmulator) handleBatchGet(w http.ResponseWriter, r *http.Request) {
 	e.logRequest(r)
 
@@ -486,12 +759,14 @@ func (e *GmailEmulator) handleBatchGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	e.mu.RLock()
 	messages := []GmailMessage{}
 	for _, id := range request.Ids {
 		if msg, ok := e.messages[id]; ok {
 			messages = append(messages, *msg)
 		}
 	}
+	e.mu.RUnlock()
 
 	response := map[string][]GmailMessage{"messages": messages}
 
@@ -499,105 +774,272 @@ func (e *GmailEmulator) handleBatchGet(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// Helper methods
+func (e *GmailEmulator) handleListThreads(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
 
-func (e *GmailEmulator) filterMessages(query, labelIds string) []MessageRef {
-	filtered := []MessageRef{}
+	q := r.URL.Query().Get("q")
+	labelIds := r.URL.Query().Get("labelIds")
+	maxResults := r.URL.Query().Get("maxResults")
+	pageToken := r.URL.Query().Get("pageToken")
 
-	// Parse label IDs
-	labels := []string{}
-	if labelIds != "" {
-		labels = strings.Split(labelIds, ",")
+	limit := 100
+	if maxResults != "" {
+		if n, err := strconv.Atoi(maxResults); err == nil && n > 0 {
+			limit = n
+		}
 	}
 
-	for _, ref := range e.messageList {
-		msg := e.messages[ref.Id]
-
-		// Filter by labels
-		if len(labels) > 0 {
-			hasLabel := false
-			for _, requiredLabel := range labels {
-				for _, msgLabel := range msg.LabelIds {
-					if msgLabel == requiredLabel {
-						hasLabel = true
-						break
-					}
-				}
-				if hasLabel {
-					break
-				}
-			}
-			if !hasLabel {
-				continue
-			}
+	start := 0
+	if pageToken != "" {
+		if n, err := strconv.Atoi(pageToken); err == nil {
+			start = n
 		}
+	}
 
-		// Filter by query
-		if query != "" && !e.matchesQuery(msg, query) {
+	e.mu.RLock()
+	filtered := e.filterMessages(q, labelIds)
+	seen := make(map[string]bool)
+	threads := []ThreadRef{}
+
+	for _, ref := range filtered {
+		if seen[ref.ThreadId] {
 			continue
 		}
+		seen[ref.ThreadId] = true
 
-		filtered = append(filtered, ref)
+		msgs := e.threadIndex[ref.ThreadId]
+		snippet := ""
+		if len(msgs) > 0 {
+			snippet = msgs[len(msgs)-1].Snippet
+		}
+		threads = append(threads, ThreadRef{Id: ref.ThreadId, Snippet: snippet})
 	}
+	e.mu.RUnlock()
 
-	return filtered
+	end := start + limit
+	if end > len(threads) {
+		end = len(threads)
+	}
+	if start > len(threads) {
+		start = len(threads)
+	}
+
+	response := struct {
+		Threads            []ThreadRef `json:"threads"`
+		NextPageToken      string      `json:"nextPageToken,omitempty"`
+		ResultSizeEstimate int         `json:"resultSizeEstimate"`
+	}{
+		Threads:            threads[start:end],
+		ResultSizeEstimate: len(threads),
+	}
+
+	if end < len(threads) {
+		response.NextPageToken = strconv.Itoa(end)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-func (e *GmailEmulator) matchesQuery(msg *GmailMessage, query string) bool {
-	query = strings.ToLower(query)
+func (e *GmailEmulator) handleGetThread(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
 
-	// Simple query parsing (Gmail supports complex queries)
-	// Format: "from:email to:email subject:text after:date before:date"
+	threadId := mux.Vars(r)["threadId"]
+	format := r.URL.Query().Get("format")
 
-	parts := strings.Fields(query)
-	for _, part := range parts {
-		if strings.HasPrefix(part, "from:") {
-			from := strings.TrimPrefix(part, "from:")
-			if !e.headerContains(msg, "From", from) {
-				return false
-			}
-		} else if strings.HasPrefix(part, "to:") {
-			to := strings.TrimPrefix(part, "to:")
-			if !e.headerContains(msg, "To", to) {
-				return false
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	msgs, ok := e.threadIndex[threadId]
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Thread not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	thread := &Thread{Id: threadId, HistoryId: msgs[len(msgs)-1].HistoryId}
+	for _, msg := range msgs {
+		m := msg
+		if format == "metadata" || format == "minimal" {
+			copy := *msg
+			if format == "minimal" {
+				copy.Payload = nil
+			} else if copy.Payload != nil {
+				payload := *copy.Payload
+				payload.Body = nil
+				payload.Parts = nil
+				copy.Payload = &payload
 			}
-		} else if strings.HasPrefix(part, "subject:") {
-			subject := strings.TrimPrefix(part, "subject:")
-			if !e.headerContains(msg, "Subject", subject) {
-				return false
+			m = &copy
+		}
+		thread.Messages = append(thread.Messages, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+func (e *GmailEmulator) handleModifyThread(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	threadId := mux.Vars(r)["threadId"]
+
+	var req struct {
+		AddLabelIds    []string `json:"addLabelIds"`
+		RemoveLabelIds []string `json:"removeLabelIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	msgs, ok := e.threadIndex[threadId]
+	if ok {
+		for _, msg := range msgs {
+			e.applyLabelChanges(msg, req.AddLabelIds, req.RemoveLabelIds)
+			if len(req.AddLabelIds) > 0 {
+				msg.HistoryId = e.recordHistory(HistoryLabelAdded, msg.Id, msg.ThreadId, req.AddLabelIds)
 			}
-		} else if strings.HasPrefix(part, "after:") {
-			// Parse date and compare
-			dateStr := strings.TrimPrefix(part, "after:")
-			if after, err := parseQueryDate(dateStr); err == nil {
-				msgTime := e.getMessageTime(msg)
-				if msgTime.Before(after) {
-					return false
-				}
+			if len(req.RemoveLabelIds) > 0 {
+				msg.HistoryId = e.recordHistory(HistoryLabelRemoved, msg.Id, msg.ThreadId, req.RemoveLabelIds)
 			}
-		} else if strings.HasPrefix(part, "before:") {
-			dateStr := strings.TrimPrefix(part, "before:")
-			if before, err := parseQueryDate(dateStr); err == nil {
-				msgTime := e.getMessageTime(msg)
-				if msgTime.After(before) {
-					return false
-				}
+		}
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Thread not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	e.handleGetThread(w, r)
+}
+
+func (e *GmailEmulator) handleTrashThread(w http.ResponseWriter, r *http.Request) {
+	e.modifyThreadLabels(w, r, []string{"TRASH"}, nil)
+}
+
+func (e *GmailEmulator) handleUntrashThread(w http.ResponseWriter, r *http.Request) {
+	e.modifyThreadLabels(w, r, nil, []string{"TRASH"})
+}
+
+func (e *GmailEmulator) modifyThreadLabels(w http.ResponseWriter, r *http.Request, add, remove []string) {
+	e.logRequest(r)
+
+	threadId := mux.Vars(r)["threadId"]
+
+	e.mu.Lock()
+	msgs, ok := e.threadIndex[threadId]
+	if ok {
+		for _, msg := range msgs {
+			e.applyLabelChanges(msg, add, remove)
+			if len(add) > 0 {
+				msg.HistoryId = e.recordHistory(HistoryLabelAdded, msg.Id, msg.ThreadId, add)
 			}
-		} else {
-			// General text search in subject and snippet
-			found := false
-			if e.headerContains(msg, "Subject", part) || strings.Contains(strings.ToLower(msg.Snippet), part) {
-				found = true
+			if len(remove) > 0 {
+				msg.HistoryId = e.recordHistory(HistoryLabelRemoved, msg.Id, msg.ThreadId, remove)
 			}
-			if !found {
-				return false
+		}
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Thread not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	e.handleGetThread(w, r)
+}
+
+// applyLabelChanges adds/removes labels on a single message in place and
+// keeps labelIndex (index.go) in sync, so every label-mutating write path
+// - modify, trash/untrash, thread-level modify/trash/untrash, send-draft -
+// stays indexed through this one chokepoint. The caller is responsible
+// for holding e.mu.
+func (e *GmailEmulator) applyLabelChanges(msg *GmailMessage, addLabelIds, removeLabelIds []string) {
+	for _, label := range addLabelIds {
+		if !e.hasLabel(msg, label) {
+			msg.LabelIds = append(msg.LabelIds, label)
+		}
+	}
+
+	if len(removeLabelIds) > 0 {
+		remove := make(map[string]bool, len(removeLabelIds))
+		for _, label := range removeLabelIds {
+			remove[label] = true
+		}
+
+		filtered := msg.LabelIds[:0]
+		for _, label := range msg.LabelIds {
+			if !remove[label] {
+				filtered = append(filtered, label)
 			}
 		}
+		msg.LabelIds = filtered
+	}
+
+	e.syncLabelIndex(msg)
+}
+
+// handleListHistory itself now lives in history.go, backed by the
+// persistent historyLog every write handler appends to.
+
+// Helper methods
+
+// filterMessages compiles query + labelIds into bitmap operations over
+// the indexes in index.go wherever that's sound, falling back to a
+// per-message Eval (query.go) only for whatever the indexes can't answer
+// exactly, and only over the already-narrowed candidate set. Results come
+// back newest-first, the reverse of messagesByDate's oldest-first order.
+func (e *GmailEmulator) filterMessages(query, labelIds string) []MessageRef {
+	var labels []string
+	if labelIds != "" {
+		labels = strings.Split(labelIds, ",")
+	}
+
+	var bitmap *roaring.Bitmap
+	var residual queryNode
+
+	if query != "" {
+		bitmap, residual = e.planFilter(parseQuery(query))
+	}
+
+	if len(labels) > 0 {
+		labelBitmap := e.unionLabelBitmap(labels)
+		if bitmap == nil {
+			bitmap = labelBitmap
+		} else {
+			bitmap.And(labelBitmap)
+		}
+	}
+
+	if bitmap == nil {
+		bitmap = e.universeBitmap()
 	}
 
-	return true
+	ordinals := bitmap.ToArray()
+	filtered := make([]MessageRef, 0, len(ordinals))
+
+	for i := len(ordinals) - 1; i >= 0; i-- {
+		msg := e.messagesByDate[ordinals[i]]
+		if _, alive := e.messages[msg.Id]; !alive {
+			continue
+		}
+		if residual != nil && !residual.Eval(e, msg) {
+			continue
+		}
+		filtered = append(filtered, MessageRef{Id: msg.Id, ThreadId: msg.ThreadId})
+	}
+
+	return filtered
 }
 
+// matchesQuery itself now lives in query.go, built on a recursive-descent
+// parser over Gmail's full search operator grammar. filterMessages above
+// does not call it: it evaluates the same parsed AST (queryNode.Eval) only
+// for the residual part of a query that index.go's planFilter couldn't
+// prove from the indexes alone.
+
 func (e *GmailEmulator) headerContains(msg *GmailMessage, headerName, value string) bool {
 	if msg.Payload == nil {
 		return false
@@ -612,6 +1054,61 @@ func (e *GmailEmulator) headerContains(msg *GmailMessage, headerName, value stri
 	return false
 }
 
+func (e *GmailEmulator) hasLabel(msg *GmailMessage, label string) bool {
+	label = strings.ToUpper(label)
+	for _, l := range msg.LabelIds {
+		if strings.ToUpper(l) == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *GmailEmulator) hasAttachment(msg *GmailMessage) bool {
+	if msg.Payload == nil {
+		return false
+	}
+	return payloadHasAttachment(msg.Payload)
+}
+
+func payloadHasAttachment(part *MessagePart) bool {
+	if part.Filename != "" {
+		return true
+	}
+	for i := range part.Parts {
+		if payloadHasAttachment(&part.Parts[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRelativeDate parses Gmail's newer_than:/older_than: durations, e.g.
+// "1d", "2w", "3m", "1y", relative to now.
+func parseRelativeDate(value string) (time.Time, error) {
+	if len(value) < 2 {
+		return time.Time{}, fmt.Errorf("invalid relative date: %s", value)
+	}
+
+	n, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid relative date: %s", value)
+	}
+
+	switch value[len(value)-1] {
+	case 'd':
+		return time.Now().AddDate(0, 0, -n), nil
+	case 'w':
+		return time.Now().AddDate(0, 0, -7*n), nil
+	case 'm':
+		return time.Now().AddDate(0, -n, 0), nil
+	case 'y':
+		return time.Now().AddDate(-n, 0, 0), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid relative date: %s", value)
+}
+
 func (e *GmailEmulator) getMessageTime(msg *GmailMessage) time.Time {
 	if ts, err := strconv.ParseInt(msg.InternalDate, 10, 64); err == nil {
 		return time.Unix(ts/1000, 0)
@@ -652,12 +1149,14 @@ func (e *GmailEmulator) countThreads() int {
 }
 
 func (e *GmailEmulator) logRequest(r *http.Request) {
+	e.mu.Lock()
 	e.requestLog = append(e.requestLog, RequestLog{
 		Method:    r.Method,
 		Path:      r.URL.Path,
 		Query:     r.URL.RawQuery,
 		Timestamp: time.Now(),
 	})
+	e.mu.Unlock()
 }
 
 // OAuth endpoints (mock implementation)
@@ -677,6 +1176,7 @@ func (e *GmailEmulator) handleOAuth(w http.ResponseWriter, r *http.Request) {
 
 // Health check
 func (e *GmailEmulator) handleHealth(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
 	health := map[string]interface{}{
 		"status":   "healthy",
 		"messages": len(e.messages),
@@ -685,6 +1185,7 @@ func (e *GmailEmulator) handleHealth(w http.ResponseWriter, r *http.Request) {
 		"uptime":   time.Since(startTime).String(),
 		"requests": len(e.requestLog),
 	}
+	e.mu.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(health)
@@ -692,6 +1193,7 @@ func (e *GmailEmulator) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // Debug endpoints
 func (e *GmailEmulator) handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
 	labelStats := make(map[string]int)
 	for _, msg := range e.messages {
 		for _, label := range msg.LabelIds {
@@ -713,6 +1215,7 @@ func (e *GmailEmulator) handleDebugStats(w http.ResponseWriter, r *http.Request)
 		"topUsers":          topUsers,
 		"recentRequests":    e.requestLog[max(0, len(e.requestLog)-10):],
 	}
+	e.mu.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
@@ -746,6 +1249,116 @@ func (e *GmailEmulator) handleListEndpoints(w http.ResponseWriter, r *http.Reque
 			"path":        "/gmail/v1/users/{userId}/messages/batchGet",
 			"description": "Batch get multiple messages",
 		},
+		{
+			"method":      "GET",
+			"path":        "/gmail/v1/users/{userId}/messages/{messageId}/attachments/{attachmentId}",
+			"description": "Get a message attachment's base64url data",
+		},
+		{
+			"method":      "GET",
+			"path":        "/gmail/v1/users/{userId}/threads",
+			"description": "List threads (supports q, labelIds, pageToken, maxResults parameters)",
+		},
+		{
+			"method":      "GET",
+			"path":        "/gmail/v1/users/{userId}/threads/{threadId}",
+			"description": "Get a specific thread with its messages",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/threads/{threadId}/modify",
+			"description": "Add/remove labels on every message in a thread",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/threads/{threadId}/trash",
+			"description": "Move every message in a thread to Trash",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/threads/{threadId}/untrash",
+			"description": "Remove every message in a thread from Trash",
+		},
+		{
+			"method":      "GET",
+			"path":        "/gmail/v1/users/{userId}/history",
+			"description": "List history records since startHistoryId",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/messages/send",
+			"description": "Send a message (raw MIME blob or structured payload)",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/messages/{messageId}/modify",
+			"description": "Add/remove labels on a message",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/messages/{messageId}/trash",
+			"description": "Move a message to Trash",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/messages/{messageId}/untrash",
+			"description": "Remove a message from Trash",
+		},
+		{
+			"method":      "DELETE",
+			"path":        "/gmail/v1/users/{userId}/messages/{messageId}",
+			"description": "Permanently delete a message",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/drafts",
+			"description": "Create a draft",
+		},
+		{
+			"method":      "GET",
+			"path":        "/gmail/v1/users/{userId}/drafts",
+			"description": "List drafts",
+		},
+		{
+			"method":      "GET",
+			"path":        "/gmail/v1/users/{userId}/drafts/{draftId}",
+			"description": "Get a draft",
+		},
+		{
+			"method":      "PUT",
+			"path":        "/gmail/v1/users/{userId}/drafts/{draftId}",
+			"description": "Replace a draft's contents",
+		},
+		{
+			"method":      "DELETE",
+			"path":        "/gmail/v1/users/{userId}/drafts/{draftId}",
+			"description": "Delete a draft",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/drafts/send",
+			"description": "Send an existing draft",
+		},
+		{
+			"method":      "POST",
+			"path":        "/gmail/v1/users/{userId}/labels",
+			"description": "Create a user label",
+		},
+		{
+			"method":      "GET",
+			"path":        "/gmail/v1/users/{userId}/labels/{labelId}",
+			"description": "Get a label",
+		},
+		{
+			"method":      "PATCH",
+			"path":        "/gmail/v1/users/{userId}/labels/{labelId}",
+			"description": "Update a user label",
+		},
+		{
+			"method":      "DELETE",
+			"path":        "/gmail/v1/users/{userId}/labels/{labelId}",
+			"description": "Delete a user label",
+		},
 		{
 			"method":      "POST",
 			"path":        "/oauth2/v4/token",
@@ -775,7 +1388,7 @@ func (e *GmailEmulator) handleListEndpoints(w http.ResponseWriter, r *http.Reque
 
 	response := map[string]interface{}{
 		"endpoints":   endpoints,
-		"version":     "2.3",
+		"version":     "2.11",
 		"description": "Gmail API Emulator serving Enron email data",
 	}
 
@@ -797,6 +1410,8 @@ func main() {
 		dataPath  = flag.String("data", "./test-data", "Path to test data directory")
 		port      = flag.Int("port", 8080, "Port to listen on")
 		userEmail = flag.String("email", "test@example.com", "Test user email address")
+		imapPort  = flag.Int("imap-port", 0, "Port to serve IMAP on (0 disables)")
+		smtpPort  = flag.Int("smtp-port", 0, "Port to accept SMTP submissions on (0 disables)")
 	)
 
 	flag.Parse()
@@ -816,6 +1431,30 @@ func main() {
 	r.HandleFunc("/gmail/v1/users/{userId}/messages", emulator.handleListMessages).Methods("GET")
 	r.HandleFunc("/gmail/v1/users/{userId}/messages/{messageId}", emulator.handleGetMessage).Methods("GET")
 	r.HandleFunc("/gmail/v1/users/{userId}/messages/batchGet", emulator.handleBatchGet).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/messages/{messageId}/attachments/{attachmentId}", emulator.handleGetAttachment).Methods("GET")
+	r.HandleFunc("/gmail/v1/users/{userId}/threads", emulator.handleListThreads).Methods("GET")
+	r.HandleFunc("/gmail/v1/users/{userId}/threads/{threadId}", emulator.handleGetThread).Methods("GET")
+	r.HandleFunc("/gmail/v1/users/{userId}/threads/{threadId}/modify", emulator.handleModifyThread).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/threads/{threadId}/trash", emulator.handleTrashThread).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/threads/{threadId}/untrash", emulator.handleUntrashThread).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/history", emulator.handleListHistory).Methods("GET")
+
+	// Write endpoints: compose/send, drafts, and labels CRUD
+	r.HandleFunc("/gmail/v1/users/{userId}/messages/send", emulator.handleSendMessage).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/messages/{messageId}/modify", emulator.handleModifyMessage).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/messages/{messageId}/trash", emulator.handleTrashMessage).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/messages/{messageId}/untrash", emulator.handleUntrashMessage).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/messages/{messageId}", emulator.handleDeleteMessage).Methods("DELETE")
+	r.HandleFunc("/gmail/v1/users/{userId}/drafts", emulator.handleCreateDraft).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/drafts", emulator.handleListDrafts).Methods("GET")
+	r.HandleFunc("/gmail/v1/users/{userId}/drafts/send", emulator.handleSendDraft).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/drafts/{draftId}", emulator.handleGetDraft).Methods("GET")
+	r.HandleFunc("/gmail/v1/users/{userId}/drafts/{draftId}", emulator.handleUpdateDraft).Methods("PUT")
+	r.HandleFunc("/gmail/v1/users/{userId}/drafts/{draftId}", emulator.handleDeleteDraft).Methods("DELETE")
+	r.HandleFunc("/gmail/v1/users/{userId}/labels", emulator.handleCreateLabel).Methods("POST")
+	r.HandleFunc("/gmail/v1/users/{userId}/labels/{labelId}", emulator.handleGetLabel).Methods("GET")
+	r.HandleFunc("/gmail/v1/users/{userId}/labels/{labelId}", emulator.handleUpdateLabel).Methods("PATCH")
+	r.HandleFunc("/gmail/v1/users/{userId}/labels/{labelId}", emulator.handleDeleteLabel).Methods("DELETE")
 
 	// OAuth mock endpoints
 	r.HandleFunc("/oauth2/v4/token", emulator.handleOAuth).Methods("POST")
@@ -837,6 +1476,35 @@ func main() {
 
 	handler := c.Handler(r)
 
+	// IMAP and SMTP frontends read the same gmail_messages.json dataset
+	// as the REST API above, each keeping its own independent in-memory
+	// copy; SMTP also appends submissions to it, while IMAP flag changes
+	// stay in the bridge's memory. startReloadPolling (persist.go) is what
+	// lets SMTP's writes become visible here without a restart, and the
+	// write handlers in write.go persist REST's own writes back to the
+	// same file so the IMAP/SMTP frontends can eventually pick them up too.
+	emulator.startReloadPolling(2 * time.Second)
+
+	if *imapPort != 0 {
+		imapAddr := fmt.Sprintf(":%d", *imapPort)
+		go func() {
+			log.Printf("IMAP bridge starting on %s", imapAddr)
+			if err := imapserver.ListenAndServe(*dataPath, *userEmail, imapAddr); err != nil {
+				log.Printf("IMAP bridge stopped: %v", err)
+			}
+		}()
+	}
+
+	if *smtpPort != 0 {
+		smtpAddr := fmt.Sprintf(":%d", *smtpPort)
+		go func() {
+			log.Printf("SMTP submission server starting on %s", smtpAddr)
+			if err := smtpserver.ListenAndServe(*dataPath, smtpAddr); err != nil {
+				log.Printf("SMTP submission server stopped: %v", err)
+			}
+		}()
+	}
+
 	log.Printf("Gmail API Emulator starting on port %d", *port)
 	log.Printf("Serving data from: %s", *dataPath)
 	log.Printf("Test user email: %s", *userEmail)
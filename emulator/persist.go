@@ -0,0 +1,110 @@
+// persist.go
+//
+// Keeps gmail_messages.json in sync between the REST emulator and the
+// IMAP/SMTP frontends (imapserver, smtpserver), which each load their own
+// independent in-memory copy of the same file and never notify this
+// process of changes. Write handlers in write.go call
+// persistMessagesLocked after mutating messages so their changes reach
+// disk; startReloadPolling periodically re-reads the file so messages
+// appended over SMTP (or edits made to the dataset by hand) become visible
+// here without a restart. IMAP flag changes are kept only in the IMAP
+// bridge's memory and are not written to the file.
+// Version: 1.0
+// Last Updated: 2025-07-26
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (e *GmailEmulator) messagesFilePath() string {
+	return filepath.Join(e.dataPath, "gmail_messages.json")
+}
+
+// persistMessagesLocked writes every message still in e.messages, in
+// messagesByDate order, back to gmail_messages.json; deleted messages
+// stay in messagesByDate (see handleDeleteMessage) but are left out here.
+// The caller is responsible for holding e.mu (write lock).
+func (e *GmailEmulator) persistMessagesLocked() {
+	alive := make([]*GmailMessage, 0, len(e.messages))
+	for _, msg := range e.messagesByDate {
+		if _, ok := e.messages[msg.Id]; ok {
+			alive = append(alive, msg)
+		}
+	}
+
+	data, err := json.MarshalIndent(alive, "", "  ")
+	if err != nil {
+		log.Printf("persist messages: marshal: %v", err)
+		return
+	}
+
+	path := e.messagesFilePath()
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Printf("persist messages: write: %v", err)
+		return
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		e.lastLoadedModTime = info.ModTime()
+	}
+}
+
+// startReloadPolling periodically reloads gmail_messages.json if it has
+// changed on disk since this emulator's own last load/persist, picking up
+// messages sent over SMTP, which appends to the same file from its own
+// independent in-memory copy (see smtpserver/smtp_server.go). Flags
+// changed over IMAP are not written to the file and so are not picked up.
+func (e *GmailEmulator) startReloadPolling(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.reloadIfChanged()
+		}
+	}()
+}
+
+func (e *GmailEmulator) reloadIfChanged() {
+	path := e.messagesFilePath()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	e.mu.RLock()
+	unchanged := !info.ModTime().After(e.lastLoadedModTime)
+	e.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("reload messages: read: %v", err)
+		return
+	}
+
+	var messageSlice []*GmailMessage
+	if err := json.Unmarshal(data, &messageSlice); err != nil {
+		log.Printf("reload messages: unmarshal: %v", err)
+		return
+	}
+
+	e.mu.Lock()
+	e.rebuildFromMessages(messageSlice)
+	e.lastLoadedModTime = info.ModTime()
+	e.mu.Unlock()
+
+	log.Printf("Reloaded %d messages from %s (external change detected)", len(messageSlice), path)
+}
@@ -0,0 +1,386 @@
+// query.go
+//
+// Gmail's advanced search operator grammar (cc:/bcc:/label:/-label:/
+// has:attachment/filename:/larger:/smaller:/is:/in:/newer_than:/older_than:/
+// quoted phrases/OR/parens), as a small recursive-descent parser over an AST
+// that replaces the old Fields()-and-AND-them-all matchesQuery.
+// Version: 1.0
+// Last Updated: 2025-07-22
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// queryNode is one node of a parsed search query.
+type queryNode interface {
+	Eval(e *GmailEmulator, msg *GmailMessage) bool
+}
+
+// AndNode matches when every child matches. An empty AndNode matches
+// everything, so a blank query is a no-op filter.
+type AndNode struct {
+	Children []queryNode
+}
+
+func (n *AndNode) Eval(e *GmailEmulator, msg *GmailMessage) bool {
+	for _, child := range n.Children {
+		if !child.Eval(e, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// OrNode matches when any child matches.
+type OrNode struct {
+	Children []queryNode
+}
+
+func (n *OrNode) Eval(e *GmailEmulator, msg *GmailMessage) bool {
+	for _, child := range n.Children {
+		if child.Eval(e, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotNode inverts its child, for Gmail's "-term" negation.
+type NotNode struct {
+	Child queryNode
+}
+
+func (n *NotNode) Eval(e *GmailEmulator, msg *GmailMessage) bool {
+	return !n.Child.Eval(e, msg)
+}
+
+// TermNode is a single leaf token: an operator:value pair, a quoted phrase,
+// or a bare word for the general text search.
+type TermNode struct {
+	Raw string
+}
+
+func (n *TermNode) Eval(e *GmailEmulator, msg *GmailMessage) bool {
+	return e.evalTerm(msg, n.Raw)
+}
+
+// tokenizeQuery splits a raw query string into tokens, keeping quoted
+// phrases (including their quotes) as a single token and "(" / ")" as
+// tokens of their own.
+func tokenizeQuery(query string) []string {
+	var tokens []string
+	var buf strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if buf.Len() > 0 {
+			tokens = append(tokens, buf.String())
+			buf.Reset()
+		}
+	}
+
+	for _, r := range query {
+		switch {
+		case r == '"':
+			buf.WriteRune(r)
+			inQuotes = !inQuotes
+			if !inQuotes {
+				flush()
+			}
+		case inQuotes:
+			buf.WriteRune(r)
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			flush()
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// queryParser is a recursive-descent parser over a flat token stream.
+// Grammar:
+//
+//	or-expr   := and-expr ("OR" and-expr)*
+//	and-expr  := unary+
+//	unary     := "(" or-expr ")" | "-" unary-term | term
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *queryParser) parseOr() queryNode {
+	children := []queryNode{p.parseAnd()}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		children = append(children, p.parseAnd())
+	}
+	if len(children) == 1 {
+		return children[0]
+	}
+	return &OrNode{Children: children}
+}
+
+func (p *queryParser) parseAnd() queryNode {
+	var children []queryNode
+	for {
+		tok := p.peek()
+		if tok == "" || tok == ")" || strings.EqualFold(tok, "OR") {
+			break
+		}
+		children = append(children, p.parseUnary())
+	}
+	if len(children) == 1 {
+		return children[0]
+	}
+	return &AndNode{Children: children}
+}
+
+func (p *queryParser) parseUnary() queryNode {
+	tok := p.peek()
+
+	if tok == "(" {
+		p.next()
+		node := p.parseOr()
+		if p.peek() == ")" {
+			p.next()
+		}
+		return node
+	}
+
+	if strings.HasPrefix(tok, "-") && len(tok) > 1 {
+		p.next()
+		return &NotNode{Child: &TermNode{Raw: tok[1:]}}
+	}
+
+	p.next()
+	return &TermNode{Raw: tok}
+}
+
+// parseQuery parses a raw Gmail-style query string into an AST. An empty or
+// whitespace-only query parses to an AndNode with no children, which
+// matches every message.
+func parseQuery(query string) queryNode {
+	tokens := tokenizeQuery(query)
+	if len(tokens) == 0 {
+		return &AndNode{}
+	}
+	p := &queryParser{tokens: tokens}
+	return p.parseOr()
+}
+
+// matchesQuery parses query into an AST and evaluates it against msg.
+func (e *GmailEmulator) matchesQuery(msg *GmailMessage, query string) bool {
+	if strings.TrimSpace(query) == "" {
+		return true
+	}
+	return parseQuery(query).Eval(e, msg)
+}
+
+// evalTerm evaluates a single leaf token - an operator:value pair, a quoted
+// phrase, or a bare word - against msg.
+func (e *GmailEmulator) evalTerm(msg *GmailMessage, raw string) bool {
+	if len(raw) >= 2 && strings.HasPrefix(raw, `"`) && strings.HasSuffix(raw, `"`) {
+		return e.textSearch(msg, strings.ToLower(raw[1:len(raw)-1]))
+	}
+
+	lower := strings.ToLower(raw)
+
+	switch {
+	case strings.HasPrefix(lower, "from:"):
+		return e.headerContains(msg, "From", strings.TrimPrefix(lower, "from:"))
+	case strings.HasPrefix(lower, "to:"):
+		return e.headerContains(msg, "To", strings.TrimPrefix(lower, "to:"))
+	case strings.HasPrefix(lower, "cc:"):
+		return e.headerContains(msg, "Cc", strings.TrimPrefix(lower, "cc:"))
+	case strings.HasPrefix(lower, "bcc:"):
+		return e.headerContains(msg, "Bcc", strings.TrimPrefix(lower, "bcc:"))
+	case strings.HasPrefix(lower, "subject:"):
+		return e.headerContains(msg, "Subject", strings.TrimPrefix(lower, "subject:"))
+	case strings.HasPrefix(lower, "label:"):
+		return e.hasLabel(msg, strings.TrimPrefix(lower, "label:"))
+	case strings.HasPrefix(lower, "filename:"):
+		return hasFilename(msg, strings.TrimPrefix(lower, "filename:"))
+	case strings.HasPrefix(lower, "larger:"):
+		return sizeMatches(msg, strings.TrimPrefix(lower, "larger:"), true)
+	case strings.HasPrefix(lower, "smaller:"):
+		return sizeMatches(msg, strings.TrimPrefix(lower, "smaller:"), false)
+	case lower == "has:attachment":
+		return e.hasAttachment(msg)
+	case strings.HasPrefix(lower, "is:"):
+		return e.evalIs(msg, strings.TrimPrefix(lower, "is:"))
+	case strings.HasPrefix(lower, "in:"):
+		return e.evalIn(msg, strings.TrimPrefix(lower, "in:"))
+	case strings.HasPrefix(lower, "after:"):
+		if after, err := parseQueryDate(strings.TrimPrefix(lower, "after:")); err == nil {
+			return !e.getMessageTime(msg).Before(after)
+		}
+		return true
+	case strings.HasPrefix(lower, "before:"):
+		if before, err := parseQueryDate(strings.TrimPrefix(lower, "before:")); err == nil {
+			return !e.getMessageTime(msg).After(before)
+		}
+		return true
+	case strings.HasPrefix(lower, "newer_than:"):
+		if after, err := parseRelativeDate(strings.TrimPrefix(lower, "newer_than:")); err == nil {
+			return !e.getMessageTime(msg).Before(after)
+		}
+		return true
+	case strings.HasPrefix(lower, "older_than:"):
+		if before, err := parseRelativeDate(strings.TrimPrefix(lower, "older_than:")); err == nil {
+			return !e.getMessageTime(msg).After(before)
+		}
+		return true
+	default:
+		return e.textSearch(msg, lower)
+	}
+}
+
+// evalIs handles is:unread|read|starred|important.
+func (e *GmailEmulator) evalIs(msg *GmailMessage, value string) bool {
+	switch value {
+	case "unread":
+		return e.hasLabel(msg, "UNREAD")
+	case "read":
+		return !e.hasLabel(msg, "UNREAD")
+	case "starred":
+		return e.hasLabel(msg, "STARRED")
+	case "important":
+		return e.hasLabel(msg, "IMPORTANT")
+	}
+	return false
+}
+
+// evalIn handles in:inbox|sent|trash|spam.
+func (e *GmailEmulator) evalIn(msg *GmailMessage, value string) bool {
+	switch value {
+	case "inbox":
+		return e.hasLabel(msg, "INBOX")
+	case "sent":
+		return e.hasLabel(msg, "SENT")
+	case "trash":
+		return e.hasLabel(msg, "TRASH")
+	case "spam":
+		return e.hasLabel(msg, "SPAM")
+	}
+	return false
+}
+
+// textSearch checks the subject, snippet, and full decoded body for term.
+func (e *GmailEmulator) textSearch(msg *GmailMessage, term string) bool {
+	if e.headerContains(msg, "Subject", term) {
+		return true
+	}
+	if strings.Contains(strings.ToLower(msg.Snippet), term) {
+		return true
+	}
+	if msg.Payload != nil && bodyContains(msg.Payload, term) {
+		return true
+	}
+	return false
+}
+
+// bodyContains recursively base64-decodes text/plain parts and searches
+// them for term, walking Parts depth-first.
+func bodyContains(part *MessagePart, term string) bool {
+	if part == nil {
+		return false
+	}
+
+	if part.MimeType == "text/plain" && part.Body != nil && part.Body.Data != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(part.Body.Data); err == nil {
+			if strings.Contains(strings.ToLower(string(decoded)), term) {
+				return true
+			}
+		}
+	}
+
+	for i := range part.Parts {
+		if bodyContains(&part.Parts[i], term) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasFilename reports whether any part's Filename contains term.
+func hasFilename(msg *GmailMessage, term string) bool {
+	if msg.Payload == nil {
+		return false
+	}
+	return partFilenameContains(msg.Payload, term)
+}
+
+func partFilenameContains(part *MessagePart, term string) bool {
+	if strings.Contains(strings.ToLower(part.Filename), term) {
+		return true
+	}
+	for i := range part.Parts {
+		if partFilenameContains(&part.Parts[i], term) {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeMatches parses a larger:/smaller: value (plain bytes, or with a K/M
+// suffix) and compares it against msg.SizeEstimate.
+func sizeMatches(msg *GmailMessage, value string, larger bool) bool {
+	bytes, ok := parseSizeValue(value)
+	if !ok {
+		return true
+	}
+	if larger {
+		return msg.SizeEstimate > bytes
+	}
+	return msg.SizeEstimate < bytes
+}
+
+func parseSizeValue(value string) (int, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	multiplier := 1
+	numPart := value
+	switch value[len(value)-1] {
+	case 'k':
+		multiplier = 1024
+		numPart = value[:len(value)-1]
+	case 'm':
+		multiplier = 1024 * 1024
+		numPart = value[:len(value)-1]
+	}
+
+	n, err := strconv.Atoi(numPart)
+	if err != nil {
+		return 0, false
+	}
+	return n * multiplier, true
+}
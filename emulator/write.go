@@ -0,0 +1,748 @@
+// write.go
+//
+// Write endpoints for the Gmail API emulator: composing/sending mail,
+// drafts, message-level modify/trash/untrash/delete, and labels CRUD.
+// Everything here mutates GmailEmulator state under e.mu and is the
+// counterpart to the read-only handlers in main.go.
+// Version: 1.1 - Writes now feed the history.go change stream instead of
+// bumping historyId on their own.
+// Last Updated: 2025-07-23
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sendMessageRequest mirrors users.messages.send's body: either a raw
+// base64url MIME blob, or a structured payload for clients that don't want
+// to build RFC 5322 themselves.
+type sendMessageRequest struct {
+	Raw      string       `json:"raw,omitempty"`
+	ThreadId string       `json:"threadId,omitempty"`
+	Payload  *MessagePart `json:"payload,omitempty"`
+	LabelIds []string     `json:"labelIds,omitempty"`
+}
+
+// draftRequest mirrors users.drafts.{create,update}'s body.
+type draftRequest struct {
+	Message sendMessageRequest `json:"message"`
+}
+
+func (e *GmailEmulator) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	var req sendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	labelIds := req.LabelIds
+	if len(labelIds) == 0 {
+		labelIds = []string{"SENT"}
+	}
+
+	e.mu.Lock()
+	msg, err := e.buildOutgoingMessage(req.Raw, req.Payload, req.ThreadId, labelIds)
+	if err != nil {
+		e.mu.Unlock()
+		http.Error(w, fmt.Sprintf(`{"error": {"code": 400, "message": %q}}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	e.indexNewMessage(msg)
+	e.persistMessagesLocked()
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+func (e *GmailEmulator) handleCreateDraft(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	var req draftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	labelIds := req.Message.LabelIds
+	if len(labelIds) == 0 {
+		labelIds = []string{"DRAFT"}
+	}
+
+	e.mu.Lock()
+	msg, err := e.buildOutgoingMessage(req.Message.Raw, req.Message.Payload, req.Message.ThreadId, labelIds)
+	if err != nil {
+		e.mu.Unlock()
+		http.Error(w, fmt.Sprintf(`{"error": {"code": 400, "message": %q}}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	draft := &Draft{Id: e.nextID("draft"), Message: msg}
+	e.drafts[draft.Id] = draft
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
+
+func (e *GmailEmulator) handleListDrafts(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	e.mu.RLock()
+	refs := make([]DraftRef, 0, len(e.drafts))
+	for _, d := range e.drafts {
+		refs = append(refs, DraftRef{Id: d.Id, Message: MessageRef{Id: d.Message.Id, ThreadId: d.Message.ThreadId}})
+	}
+	e.mu.RUnlock()
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Id < refs[j].Id })
+
+	response := struct {
+		Drafts             []DraftRef `json:"drafts"`
+		ResultSizeEstimate int        `json:"resultSizeEstimate"`
+	}{Drafts: refs, ResultSizeEstimate: len(refs)}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (e *GmailEmulator) handleGetDraft(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	draftId := mux.Vars(r)["draftId"]
+
+	e.mu.RLock()
+	draft, ok := e.drafts[draftId]
+	e.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Draft not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
+
+func (e *GmailEmulator) handleUpdateDraft(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	draftId := mux.Vars(r)["draftId"]
+
+	var req draftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	draft, ok := e.drafts[draftId]
+	if !ok {
+		e.mu.Unlock()
+		http.Error(w, `{"error": {"code": 404, "message": "Draft not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	labelIds := req.Message.LabelIds
+	if len(labelIds) == 0 {
+		labelIds = draft.Message.LabelIds
+	}
+
+	updated, err := e.buildOutgoingMessage(req.Message.Raw, req.Message.Payload, req.Message.ThreadId, labelIds)
+	if err != nil {
+		e.mu.Unlock()
+		http.Error(w, fmt.Sprintf(`{"error": {"code": 400, "message": %q}}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// A draft keeps its message Id and thread across revisions unless the
+	// caller explicitly moves it to a different thread.
+	updated.Id = draft.Message.Id
+	if req.Message.ThreadId == "" {
+		updated.ThreadId = draft.Message.ThreadId
+	}
+	draft.Message = updated
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
+
+func (e *GmailEmulator) handleDeleteDraft(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	draftId := mux.Vars(r)["draftId"]
+
+	e.mu.Lock()
+	_, ok := e.drafts[draftId]
+	delete(e.drafts, draftId)
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Draft not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *GmailEmulator) handleSendDraft(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	var req struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	draft, ok := e.drafts[req.Id]
+	if !ok {
+		e.mu.Unlock()
+		http.Error(w, `{"error": {"code": 404, "message": "Draft not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	msg := draft.Message
+	e.applyLabelChanges(msg, []string{"SENT"}, []string{"DRAFT"})
+	e.indexNewMessage(msg)
+	delete(e.drafts, req.Id)
+	e.persistMessagesLocked()
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+func (e *GmailEmulator) handleModifyMessage(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	messageId := mux.Vars(r)["messageId"]
+
+	var req struct {
+		AddLabelIds    []string `json:"addLabelIds"`
+		RemoveLabelIds []string `json:"removeLabelIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	msg, ok := e.messages[messageId]
+	if ok {
+		e.applyLabelChanges(msg, req.AddLabelIds, req.RemoveLabelIds)
+		if len(req.AddLabelIds) > 0 {
+			msg.HistoryId = e.recordHistory(HistoryLabelAdded, msg.Id, msg.ThreadId, req.AddLabelIds)
+		}
+		if len(req.RemoveLabelIds) > 0 {
+			msg.HistoryId = e.recordHistory(HistoryLabelRemoved, msg.Id, msg.ThreadId, req.RemoveLabelIds)
+		}
+		e.persistMessagesLocked()
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Message not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	e.handleGetMessage(w, r)
+}
+
+func (e *GmailEmulator) handleTrashMessage(w http.ResponseWriter, r *http.Request) {
+	e.modifyMessageLabels(w, r, []string{"TRASH"}, nil)
+}
+
+func (e *GmailEmulator) handleUntrashMessage(w http.ResponseWriter, r *http.Request) {
+	e.modifyMessageLabels(w, r, nil, []string{"TRASH"})
+}
+
+func (e *GmailEmulator) modifyMessageLabels(w http.ResponseWriter, r *http.Request, add, remove []string) {
+	e.logRequest(r)
+
+	messageId := mux.Vars(r)["messageId"]
+
+	e.mu.Lock()
+	msg, ok := e.messages[messageId]
+	if ok {
+		e.applyLabelChanges(msg, add, remove)
+		if len(add) > 0 {
+			msg.HistoryId = e.recordHistory(HistoryLabelAdded, msg.Id, msg.ThreadId, add)
+		}
+		if len(remove) > 0 {
+			msg.HistoryId = e.recordHistory(HistoryLabelRemoved, msg.Id, msg.ThreadId, remove)
+		}
+		e.persistMessagesLocked()
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Message not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	e.handleGetMessage(w, r)
+}
+
+// handleDeleteMessage permanently deletes a message. messagesByDate is
+// append-only (its positions are the ordinals index.go's bitmaps are keyed
+// on), so this drops the message from e.messages, messageList,
+// threadIndex, and the label bitmaps but leaves messagesByDate and
+// tokenIndex as they are; filterMessages treats any ordinal missing from
+// e.messages as deleted rather than ever renumbering messagesByDate.
+func (e *GmailEmulator) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	messageId := mux.Vars(r)["messageId"]
+
+	e.mu.Lock()
+	msg, ok := e.messages[messageId]
+	if ok {
+		e.recordHistory(HistoryMessageDeleted, msg.Id, msg.ThreadId, nil)
+		e.removeFromLabelIndex(msg)
+		delete(e.messages, messageId)
+		e.removeFromMessageList(messageId)
+		e.removeFromThreadIndex(msg)
+		e.buildUserList()
+		e.persistMessagesLocked()
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Message not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *GmailEmulator) handleCreateLabel(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	var req struct {
+		Name                  string `json:"name"`
+		MessageListVisibility string `json:"messageListVisibility"`
+		LabelListVisibility   string `json:"labelListVisibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	label := &Label{
+		Id:                    e.nextID("label"),
+		Name:                  req.Name,
+		MessageListVisibility: req.MessageListVisibility,
+		LabelListVisibility:   req.LabelListVisibility,
+		Type:                  "user",
+	}
+	e.userLabels[label.Id] = label
+	e.bumpHistoryIdOnly()
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(label)
+}
+
+func (e *GmailEmulator) handleGetLabel(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	labelId := mux.Vars(r)["labelId"]
+
+	e.mu.RLock()
+	label, ok := e.userLabels[labelId]
+	e.mu.RUnlock()
+
+	if ok {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(label)
+		return
+	}
+
+	for _, sys := range systemLabels {
+		if sys.Id == labelId {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sys)
+			return
+		}
+	}
+
+	http.Error(w, `{"error": {"code": 404, "message": "Label not found"}}`, http.StatusNotFound)
+}
+
+func (e *GmailEmulator) handleUpdateLabel(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	labelId := mux.Vars(r)["labelId"]
+
+	var req struct {
+		Name                  string `json:"name"`
+		MessageListVisibility string `json:"messageListVisibility"`
+		LabelListVisibility   string `json:"labelListVisibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": {"code": 400, "message": "Invalid request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	label, ok := e.userLabels[labelId]
+	if ok {
+		if req.Name != "" {
+			label.Name = req.Name
+		}
+		if req.MessageListVisibility != "" {
+			label.MessageListVisibility = req.MessageListVisibility
+		}
+		if req.LabelListVisibility != "" {
+			label.LabelListVisibility = req.LabelListVisibility
+		}
+		e.bumpHistoryIdOnly()
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Label not found, or is a system label"}}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(label)
+}
+
+func (e *GmailEmulator) handleDeleteLabel(w http.ResponseWriter, r *http.Request) {
+	e.logRequest(r)
+
+	labelId := mux.Vars(r)["labelId"]
+
+	e.mu.Lock()
+	_, ok := e.userLabels[labelId]
+	if ok {
+		delete(e.userLabels, labelId)
+		e.bumpHistoryIdOnly()
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error": {"code": 404, "message": "Label not found, or is a system label"}}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// buildOutgoingMessage constructs a brand new GmailMessage from either a raw
+// base64url MIME blob or a structured payload, assigning a fresh Id and
+// threading it by In-Reply-To/References the way the transformer threads
+// the Enron corpus. The caller is responsible for holding e.mu.
+func (e *GmailEmulator) buildOutgoingMessage(raw string, payload *MessagePart, threadId string, labelIds []string) (*GmailMessage, error) {
+	var built *MessagePart
+	var err error
+
+	switch {
+	case raw != "":
+		built, err = decodeRawMIME(raw)
+		if err != nil {
+			return nil, err
+		}
+	case payload != nil:
+		built = payload
+		numberParts(built.Parts, "")
+	default:
+		return nil, fmt.Errorf("message must include raw or payload")
+	}
+
+	id := e.nextID("msg")
+
+	msg := &GmailMessage{
+		Id:           id,
+		LabelIds:     labelIds,
+		InternalDate: strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+		Payload:      built,
+	}
+	msg.Snippet = snippetFromPayload(built)
+	msg.SizeEstimate = estimatePayloadSize(built)
+
+	if threadId != "" {
+		msg.ThreadId = threadId
+	} else {
+		msg.ThreadId = e.resolveThreadId(built.Headers, id)
+	}
+
+	// A fresh historyId is assigned here without a historyLog entry: this
+	// message may still be an unsent draft, which isn't part of the synced
+	// mailbox. indexNewMessage records the messageAdded entry once a
+	// message actually lands in the mailbox (sent, or a draft being sent).
+	msg.HistoryId = e.bumpHistoryIdOnly()
+
+	return msg, nil
+}
+
+// indexNewMessage registers a freshly created/sent message in every index
+// the read handlers rely on, and records its arrival in the history log.
+// messagesByDate is append-only, so a new message's ordinal (its position
+// here) is stable for the rest of the process's life, same as every other
+// loaded message's. The caller is responsible for holding e.mu.
+func (e *GmailEmulator) indexNewMessage(msg *GmailMessage) {
+	msg.HistoryId = e.recordHistory(HistoryMessageAdded, msg.Id, msg.ThreadId, nil)
+	e.messages[msg.Id] = msg
+	e.messageList = append(e.messageList, MessageRef{Id: msg.Id, ThreadId: msg.ThreadId})
+	e.messagesByDate = append(e.messagesByDate, msg)
+	e.threadIndex[msg.ThreadId] = append(e.threadIndex[msg.ThreadId], msg)
+
+	ordinal := len(e.messagesByDate) - 1
+	e.ordinalOf[msg.Id] = ordinal
+	e.indexMessageLabels(msg, ordinal)
+	e.indexMessageTokens(msg, ordinal)
+
+	e.buildUserList()
+}
+
+func (e *GmailEmulator) removeFromMessageList(id string) {
+	filtered := e.messageList[:0]
+	for _, ref := range e.messageList {
+		if ref.Id != id {
+			filtered = append(filtered, ref)
+		}
+	}
+	e.messageList = filtered
+}
+
+func (e *GmailEmulator) removeFromThreadIndex(msg *GmailMessage) {
+	msgs := e.threadIndex[msg.ThreadId]
+	filtered := msgs[:0]
+	for _, m := range msgs {
+		if m.Id != msg.Id {
+			filtered = append(filtered, m)
+		}
+	}
+	if len(filtered) == 0 {
+		delete(e.threadIndex, msg.ThreadId)
+	} else {
+		e.threadIndex[msg.ThreadId] = filtered
+	}
+}
+
+// nextID mints a new id, scoped by prefix so messages/drafts/labels can
+// never collide even if minted in the same instant.
+func (e *GmailEmulator) nextID(prefix string) string {
+	e.idSeq++
+	sum := md5.Sum([]byte(fmt.Sprintf("%s:%d:%d", prefix, time.Now().UnixNano(), e.idSeq)))
+	return fmt.Sprintf("%x", sum)[:16]
+}
+
+func headerValue(headers []Header, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+var messageIDRefPattern = regexp.MustCompile(`<([^<>]+)>`)
+
+// findMessageByMessageID looks up an existing message by its RFC 5322
+// Message-ID header.
+func (e *GmailEmulator) findMessageByMessageID(messageID string) *GmailMessage {
+	messageID = strings.TrimSpace(messageID)
+	if messageID == "" {
+		return nil
+	}
+	for _, msg := range e.messagesByDate {
+		if strings.TrimSpace(e.getHeader(msg, "Message-ID")) == messageID {
+			return msg
+		}
+	}
+	return nil
+}
+
+// resolveThreadId threads a new outgoing message the same way the
+// transformer threads the Enron corpus: by In-Reply-To first, then by
+// walking References from most to least recent. A message with no
+// recognized parent starts its own thread.
+func (e *GmailEmulator) resolveThreadId(headers []Header, newID string) string {
+	if parent := e.findMessageByMessageID(headerValue(headers, "In-Reply-To")); parent != nil {
+		return parent.ThreadId
+	}
+
+	refs := messageIDRefPattern.FindAllString(headerValue(headers, "References"), -1)
+	for i := len(refs) - 1; i >= 0; i-- {
+		if parent := e.findMessageByMessageID(refs[i]); parent != nil {
+			return parent.ThreadId
+		}
+	}
+
+	return newID
+}
+
+// decodeRawMIME parses a base64url (or, failing that, standard base64)
+// encoded RFC 5322 message into a MessagePart tree.
+func decodeRawMIME(raw string) (*MessagePart, error) {
+	data, err := base64.URLEncoding.WithPadding(base64.NoPadding).DecodeString(raw)
+	if err != nil {
+		if data, err = base64.StdEncoding.DecodeString(raw); err != nil {
+			return nil, fmt.Errorf("decode raw message: %w", err)
+		}
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse raw message: %w", err)
+	}
+
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read message body: %w", err)
+	}
+
+	part, err := parseMIMEEntity(collectHeaders(textproto.MIMEHeader(m.Header)), m.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, err
+	}
+
+	numberParts(part.Parts, "")
+	return part, nil
+}
+
+// parseMIMEEntity turns one MIME entity - possibly multipart/* - into a
+// MessagePart tree, recursing into nested multipart bodies.
+func parseMIMEEntity(headers []Header, contentType string, body []byte) (*MessagePart, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		part := &MessagePart{MimeType: mediaType, Headers: headers}
+
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			data, err := ioutil.ReadAll(p)
+			if err != nil {
+				return nil, fmt.Errorf("read mime part: %w", err)
+			}
+
+			sub, err := parseMIMEEntity(collectHeaders(textproto.MIMEHeader(p.Header)), p.Header.Get("Content-Type"), data)
+			if err != nil {
+				return nil, err
+			}
+			sub.Filename = p.FileName()
+			part.Parts = append(part.Parts, *sub)
+		}
+
+		return part, nil
+	}
+
+	return &MessagePart{
+		MimeType: mediaType,
+		Headers:  headers,
+		Body: &MessageBody{
+			Size: len(body),
+			Data: base64.StdEncoding.EncodeToString(body),
+		},
+	}, nil
+}
+
+func collectHeaders(h textproto.MIMEHeader) []Header {
+	headers := make([]Header, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, Header{Name: name, Value: v})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+// numberParts assigns Gmail-style partIds: top-level children are "0",
+// "1", ...; a part's own children are numbered "<parent>.0", "<parent>.1".
+// Mirrors transformer.numberParts.
+func numberParts(parts []MessagePart, prefix string) {
+	for i := range parts {
+		id := strconv.Itoa(i)
+		if prefix != "" {
+			id = prefix + "." + id
+		}
+		parts[i].PartId = id
+		if len(parts[i].Parts) > 0 {
+			numberParts(parts[i].Parts, id)
+		}
+	}
+}
+
+// snippetFromPayload derives a Gmail-style snippet from a message's first
+// text/plain part.
+func snippetFromPayload(part *MessagePart) string {
+	text := strings.Join(strings.Fields(firstPlainText(part)), " ")
+	if len(text) > 150 {
+		text = text[:150]
+	}
+	return text
+}
+
+func firstPlainText(part *MessagePart) string {
+	if part == nil {
+		return ""
+	}
+	if part.MimeType == "text/plain" && part.Body != nil && part.Body.Data != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(part.Body.Data); err == nil {
+			return string(decoded)
+		}
+	}
+	for i := range part.Parts {
+		if s := firstPlainText(&part.Parts[i]); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// estimatePayloadSize sums every part's body size plus a fixed overhead for
+// headers, matching the transformer's SizeEstimate convention.
+func estimatePayloadSize(part *MessagePart) int {
+	size := 512
+	var walk func(p *MessagePart)
+	walk = func(p *MessagePart) {
+		if p.Body != nil {
+			size += p.Body.Size
+		}
+		for i := range p.Parts {
+			walk(&p.Parts[i])
+		}
+	}
+	walk(part)
+	return size
+}
@@ -0,0 +1,707 @@
+// imap_server.go
+//
+// IMAP bridge for the Gmail API Emulator
+// Serves the transformed Enron dataset over IMAP with Gmail label/flag mapping
+// Version: 1.1 - SEARCH now covers text/body/date criteria, not just headers
+// Last Updated: 2025-07-24
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package imapserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap-specialuse"
+)
+
+// GmailMessage mirrors the emulator/transformer representation of a
+// transformed message; kept local so this package has no dependency on
+// the emulator or transformer binaries.
+type GmailMessage struct {
+	Id           string       `json:"id"`
+	ThreadId     string       `json:"threadId"`
+	LabelIds     []string     `json:"labelIds"`
+	Snippet      string       `json:"snippet"`
+	HistoryId    string       `json:"historyId"`
+	InternalDate string       `json:"internalDate"`
+	SizeEstimate int          `json:"sizeEstimate"`
+	Payload      *MessagePart `json:"payload"`
+}
+
+type MessagePart struct {
+	PartId   string        `json:"partId,omitempty"`
+	MimeType string        `json:"mimeType"`
+	Filename string        `json:"filename,omitempty"`
+	Headers  []Header      `json:"headers"`
+	Body     *MessageBody  `json:"body,omitempty"`
+	Parts    []MessagePart `json:"parts,omitempty"`
+}
+
+type MessageBody struct {
+	Size         int    `json:"size"`
+	Data         string `json:"data,omitempty"`
+	AttachmentId string `json:"attachmentId,omitempty"`
+}
+
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// mailboxSpec describes a single IMAP mailbox derived from a Gmail label.
+type mailboxSpec struct {
+	name        string
+	labelId     string
+	specialUse  string
+	allMail     bool
+}
+
+// systemMailboxes is the fixed set of [Gmail] folders every account has,
+// modeled on real Gmail-over-IMAP and hydroxide's bridge mailbox list.
+var systemMailboxes = []mailboxSpec{
+	{name: "INBOX", labelId: "INBOX", specialUse: ""},
+	{name: "[Gmail]/Sent Mail", labelId: "SENT", specialUse: specialuse.Sent},
+	{name: "[Gmail]/Trash", labelId: "TRASH", specialUse: specialuse.Trash},
+	{name: "[Gmail]/Important", labelId: "IMPORTANT", specialUse: specialuse.Important},
+	{name: "[Gmail]/Starred", labelId: "STARRED", specialUse: specialuse.Flagged},
+	{name: "[Gmail]/All Mail", labelId: "", specialUse: specialuse.All, allMail: true},
+}
+
+// Backend implements github.com/emersion/go-imap/backend.Backend over a
+// dataset shared on disk with the REST emulator and the SMTP frontend.
+// There is exactly one user, the same test user the emulator and
+// transformer operate against.
+type Backend struct {
+	userEmail    string
+	messagesPath string
+	user         *User
+
+	lastLoadedModTime time.Time
+}
+
+// NewBackend loads gmail_messages.json from dataPath and returns an IMAP
+// backend that serves it as a single-user mailbox hierarchy.
+func NewBackend(dataPath, userEmail string) (*Backend, error) {
+	messagesPath := filepath.Join(dataPath, "gmail_messages.json")
+	data, err := ioutil.ReadFile(messagesPath)
+	if err != nil {
+		return nil, fmt.Errorf("read messages file: %w", err)
+	}
+
+	var messages []*GmailMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("unmarshal messages: %w", err)
+	}
+
+	user := &User{email: userEmail}
+	user.mailboxes = buildMailboxes(messages, &user.mu)
+
+	be := &Backend{userEmail: userEmail, messagesPath: messagesPath, user: user}
+	if info, err := os.Stat(messagesPath); err == nil {
+		be.lastLoadedModTime = info.ModTime()
+	}
+
+	return be, nil
+}
+
+func (b *Backend) Login(_ *imap.ConnInfo, username, _ string) (backend.User, error) {
+	if username != b.userEmail && username != "me" {
+		return nil, fmt.Errorf("unknown user %q", username)
+	}
+	return b.user, nil
+}
+
+// startReloadPolling periodically rebuilds the mailbox hierarchy from
+// gmail_messages.json if it has changed on disk since this backend's own
+// last load, picking up messages sent over SMTP or writes made over REST
+// (see emulator/persist.go) without requiring a restart.
+func (b *Backend) startReloadPolling(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			b.reloadIfChanged()
+		}
+	}()
+}
+
+func (b *Backend) reloadIfChanged() {
+	info, err := os.Stat(b.messagesPath)
+	if err != nil {
+		return
+	}
+
+	b.user.mu.RLock()
+	unchanged := !info.ModTime().After(b.lastLoadedModTime)
+	b.user.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	data, err := ioutil.ReadFile(b.messagesPath)
+	if err != nil {
+		log.Printf("imapserver: reload messages: read: %v", err)
+		return
+	}
+
+	var messages []*GmailMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		log.Printf("imapserver: reload messages: unmarshal: %v", err)
+		return
+	}
+
+	b.user.mu.Lock()
+	b.user.mailboxes = buildMailboxes(messages, &b.user.mu)
+	b.lastLoadedModTime = info.ModTime()
+	b.user.mu.Unlock()
+
+	log.Printf("imapserver: reloaded %d messages from %s (external change detected)", len(messages), b.messagesPath)
+}
+
+// ListenAndServe starts the IMAP server on addr. It blocks until the
+// server stops or returns an error.
+func ListenAndServe(dataPath, userEmail, addr string) error {
+	be, err := NewBackend(dataPath, userEmail)
+	if err != nil {
+		return err
+	}
+
+	be.startReloadPolling(2 * time.Second)
+
+	s := server.New(be)
+	s.Addr = addr
+	s.AllowInsecureAuth = true
+	s.Enable(specialuse.NewExtension())
+
+	return s.ListenAndServe()
+}
+
+// User implements backend.User for the single test account. mu guards
+// every Mailbox's messages slice and every *GmailMessage.LabelIds, since a
+// message can sit in more than one mailbox (e.g. INBOX and [Gmail]/All
+// Mail share the same *GmailMessage) and a STORE on one mailbox mutates
+// state visible through all the others. All Mailbox values returned by
+// this User share a pointer back to mu rather than each taking their own.
+type User struct {
+	email     string
+	mu        sync.RWMutex
+	mailboxes map[string]*Mailbox
+}
+
+func (u *User) Username() string { return u.email }
+
+func (u *User) ListMailboxes(_ bool) ([]backend.Mailbox, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	boxes := make([]backend.Mailbox, 0, len(u.mailboxes))
+	for _, mb := range u.mailboxes {
+		boxes = append(boxes, mb)
+	}
+	return boxes, nil
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	mb, ok := u.mailboxes[name]
+	if !ok {
+		return nil, fmt.Errorf("mailbox %q not found", name)
+	}
+	return mb, nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	return fmt.Errorf("mailbox creation not supported")
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	return fmt.Errorf("mailbox deletion not supported")
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	return fmt.Errorf("mailbox rename not supported")
+}
+
+func (u *User) Logout() error { return nil }
+
+// Mailbox implements backend.Mailbox over a slice of messages sharing one
+// Gmail label. UIDs are 1-based positions into messages, which is stable
+// across STORE-driven flag changes since those mutate LabelIds in place
+// rather than reordering or resizing the slice. mu is shared with the
+// owning User (and therefore with every other Mailbox it holds), because
+// the same *GmailMessage can appear in more than one mailbox's messages
+// slice and STORE on one must be visible to FETCH/SEARCH on another.
+type Mailbox struct {
+	spec     mailboxSpec
+	mu       *sync.RWMutex
+	messages []*GmailMessage
+}
+
+func buildMailboxes(messages []*GmailMessage, mu *sync.RWMutex) map[string]*Mailbox {
+	boxes := make(map[string]*Mailbox)
+
+	for _, spec := range systemMailboxes {
+		boxes[spec.name] = &Mailbox{spec: spec, mu: mu}
+	}
+
+	labelFolders := make(map[string]bool)
+
+	for _, msg := range messages {
+		for _, label := range msg.LabelIds {
+			if mb, ok := findByLabel(boxes, label); ok {
+				mb.messages = append(mb.messages, msg)
+			}
+			if strings.HasPrefix(label, "Label_") {
+				labelFolders[label] = true
+			}
+		}
+		if mb := boxes["[Gmail]/All Mail"]; mb != nil {
+			mb.messages = append(mb.messages, msg)
+		}
+	}
+
+	for label := range labelFolders {
+		name := strings.TrimPrefix(label, "Label_")
+		boxes[name] = &Mailbox{spec: mailboxSpec{name: name, labelId: label}, mu: mu}
+		for _, msg := range messages {
+			if hasLabel(msg, label) {
+				boxes[name].messages = append(boxes[name].messages, msg)
+			}
+		}
+	}
+
+	return boxes
+}
+
+func findByLabel(boxes map[string]*Mailbox, label string) (*Mailbox, bool) {
+	for _, mb := range boxes {
+		if mb.spec.labelId == label {
+			return mb, true
+		}
+	}
+	return nil, false
+}
+
+func hasLabel(msg *GmailMessage, label string) bool {
+	for _, l := range msg.LabelIds {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (mb *Mailbox) Name() string { return mb.spec.name }
+
+func (mb *Mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{Name: mb.spec.name}
+	if mb.spec.specialUse != "" {
+		info.Attributes = []string{mb.spec.specialUse}
+	}
+	return info, nil
+}
+
+func (mb *Mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	status := imap.NewMailboxStatus(mb.spec.name, items)
+	status.Messages = uint32(len(mb.messages))
+	status.UidNext = uint32(len(mb.messages) + 1)
+	status.UidValidity = 1
+	status.Unseen = mb.countUnseenLocked()
+	return status, nil
+}
+
+// countUnseenLocked requires the caller to already hold mb.mu (read or
+// write).
+func (mb *Mailbox) countUnseenLocked() uint32 {
+	var n uint32
+	for _, msg := range mb.messages {
+		if hasLabel(msg, "UNREAD") {
+			n++
+		}
+	}
+	return n
+}
+
+func (mb *Mailbox) SetSubscribed(subscribed bool) error { return nil }
+
+func (mb *Mailbox) Check() error { return nil }
+
+// ListMessages streams messages matching seqSet, fetching the requested
+// items into imap.Message values built from the Gmail payload tree.
+func (mb *Mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	for i, msg := range mb.messages {
+		seqNum := uint32(i + 1)
+		if uid {
+			if !seqSet.Contains(seqNum) {
+				continue
+			}
+		} else if !seqSet.Contains(seqNum) {
+			continue
+		}
+
+		m, err := toIMAPMessage(msg, seqNum, items)
+		if err != nil {
+			return err
+		}
+		ch <- m
+	}
+
+	return nil
+}
+
+func (mb *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	var results []uint32
+	for i, msg := range mb.messages {
+		if matchesCriteria(msg, criteria) {
+			results = append(results, uint32(i+1))
+		}
+	}
+	return results, nil
+}
+
+// matchesCriteria translates an IMAP SEARCH criteria into the same kind of
+// header/body/date matching matchesQuery does for Gmail's "q=" syntax in
+// the emulator, since the two packages can't share the unexported AST in
+// emulator/query.go.
+func matchesCriteria(msg *GmailMessage, criteria *imap.SearchCriteria) bool {
+	if criteria == nil {
+		return true
+	}
+
+	if criteria.Header != nil {
+		for name, values := range criteria.Header {
+			for _, v := range values {
+				if !headerContains(msg, name, v) {
+					return false
+				}
+			}
+		}
+	}
+
+	for _, text := range criteria.Text {
+		if !messageContains(msg, text) {
+			return false
+		}
+	}
+
+	for _, text := range criteria.Body {
+		if !bodyContains(msg.Payload, strings.ToLower(text)) {
+			return false
+		}
+	}
+
+	t := internalDate(msg)
+	if !criteria.Since.IsZero() && t.Before(criteria.Since) {
+		return false
+	}
+	if !criteria.Before.IsZero() && t.After(criteria.Before) {
+		return false
+	}
+
+	return true
+}
+
+// messageContains checks subject, snippet, and headers the way Gmail's
+// bare-word search term does.
+func messageContains(msg *GmailMessage, text string) bool {
+	text = strings.ToLower(text)
+	if strings.Contains(strings.ToLower(msg.Snippet), text) {
+		return true
+	}
+	if headerContains(msg, "Subject", text) {
+		return true
+	}
+	if headerContains(msg, "From", text) {
+		return true
+	}
+	if headerContains(msg, "To", text) {
+		return true
+	}
+	return bodyContains(msg.Payload, text)
+}
+
+// bodyContains recursively base64-decodes text/plain parts and searches
+// them for term. Mirrors emulator/query.go's bodyContains.
+func bodyContains(part *MessagePart, term string) bool {
+	if part == nil {
+		return false
+	}
+
+	if part.MimeType == "text/plain" && part.Body != nil && part.Body.Data != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(part.Body.Data); err == nil {
+			if strings.Contains(strings.ToLower(string(decoded)), term) {
+				return true
+			}
+		}
+	}
+
+	for i := range part.Parts {
+		if bodyContains(&part.Parts[i], term) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func headerContains(msg *GmailMessage, name, value string) bool {
+	if msg.Payload == nil {
+		return value == ""
+	}
+	for _, h := range msg.Payload.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return strings.Contains(strings.ToLower(h.Value), strings.ToLower(value))
+		}
+	}
+	return value == ""
+}
+
+func (mb *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return fmt.Errorf("APPEND not supported")
+}
+
+func (mb *Mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for i, msg := range mb.messages {
+		seqNum := uint32(i + 1)
+		if !seqSet.Contains(seqNum) {
+			continue
+		}
+		applyFlagUpdate(msg, operation, flags)
+	}
+	return nil
+}
+
+// applyFlagUpdate translates IMAP STORE operations back onto LabelIds,
+// the inverse of toIMAPFlags below.
+func applyFlagUpdate(msg *GmailMessage, operation imap.FlagsOp, flags []string) {
+	for _, flag := range flags {
+		switch flag {
+		case imap.SeenFlag:
+			setLabel(msg, "UNREAD", operation == imap.RemoveFlags)
+		case imap.FlaggedFlag:
+			setLabel(msg, "STARRED", operation != imap.RemoveFlags)
+		case imap.DeletedFlag:
+			setLabel(msg, "TRASH", operation != imap.RemoveFlags)
+		}
+	}
+}
+
+func setLabel(msg *GmailMessage, label string, present bool) {
+	has := hasLabel(msg, label)
+	if present && !has {
+		msg.LabelIds = append(msg.LabelIds, label)
+	} else if !present && has {
+		filtered := msg.LabelIds[:0]
+		for _, l := range msg.LabelIds {
+			if l != label {
+				filtered = append(filtered, l)
+			}
+		}
+		msg.LabelIds = filtered
+	}
+}
+
+func (mb *Mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	return fmt.Errorf("COPY not supported across label folders in this bridge")
+}
+
+func (mb *Mailbox) Expunge() error { return nil }
+
+// toIMAPMessage builds an imap.Message for the requested fetch items from
+// a Gmail message, decoding Payload.Body/Headers as needed.
+func toIMAPMessage(msg *GmailMessage, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	m := imap.NewMessage(seqNum, items)
+
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			m.Envelope = toEnvelope(msg)
+		case imap.FetchInternalDate:
+			m.InternalDate = internalDate(msg)
+		case imap.FetchRFC822Size:
+			m.Size = uint32(msg.SizeEstimate)
+		case imap.FetchFlags:
+			m.Flags = toIMAPFlags(msg)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			m.BodyStructure = toBodyStructure(msg.Payload)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err == nil {
+				literal, err := fetchSection(msg, section)
+				if err != nil {
+					return nil, err
+				}
+				m.Body[section] = literal
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func internalDate(msg *GmailMessage) time.Time {
+	var ms int64
+	fmt.Sscanf(msg.InternalDate, "%d", &ms)
+	return time.UnixMilli(ms)
+}
+
+func toIMAPFlags(msg *GmailMessage) []string {
+	flags := []string{}
+	if !hasLabel(msg, "UNREAD") {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if hasLabel(msg, "STARRED") {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	if hasLabel(msg, "TRASH") {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	if hasLabel(msg, "DRAFT") {
+		flags = append(flags, imap.DraftFlag)
+	}
+	return flags
+}
+
+func toEnvelope(msg *GmailMessage) *imap.Envelope {
+	env := &imap.Envelope{
+		Subject: getHeader(msg, "Subject"),
+		Date:    internalDate(msg),
+	}
+	if from := getHeader(msg, "From"); from != "" {
+		env.From = []*imap.Address{parseAddress(from)}
+	}
+	if to := getHeader(msg, "To"); to != "" {
+		env.To = parseAddressList(to)
+	}
+	return env
+}
+
+func getHeader(msg *GmailMessage, name string) string {
+	if msg.Payload == nil {
+		return ""
+	}
+	for _, h := range msg.Payload.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func parseAddressList(value string) []*imap.Address {
+	var addrs []*imap.Address
+	for _, part := range strings.Split(value, ",") {
+		addrs = append(addrs, parseAddress(strings.TrimSpace(part)))
+	}
+	return addrs
+}
+
+func parseAddress(value string) *imap.Address {
+	name, email := value, value
+	if idx := strings.Index(value, "<"); idx >= 0 {
+		if end := strings.Index(value[idx:], ">"); end > 0 {
+			name = strings.TrimSpace(value[:idx])
+			email = strings.TrimSpace(value[idx+1 : idx+end])
+		}
+	}
+
+	mailbox, host := email, ""
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		mailbox, host = email[:at], email[at+1:]
+	}
+
+	return &imap.Address{PersonalName: name, MailboxName: mailbox, HostName: host}
+}
+
+func toBodyStructure(part *MessagePart) *imap.BodyStructure {
+	if part == nil {
+		return &imap.BodyStructure{MIMEType: "text", MIMESubType: "plain"}
+	}
+
+	mimeType, mimeSubType := "text", "plain"
+	if idx := strings.Index(part.MimeType, "/"); idx >= 0 {
+		mimeType, mimeSubType = part.MimeType[:idx], part.MimeType[idx+1:]
+	}
+
+	bs := &imap.BodyStructure{MIMEType: mimeType, MIMESubType: mimeSubType}
+	if part.Body != nil {
+		bs.Size = uint32(part.Body.Size)
+	}
+	for i := range part.Parts {
+		bs.Parts = append(bs.Parts, toBodyStructure(&part.Parts[i]))
+	}
+	return bs
+}
+
+// fetchSection renders a BODY[...] / BODY.PEEK[...] fetch item by
+// reconstructing headers and/or the decoded body text from Payload.
+func fetchSection(msg *GmailMessage, section *imap.BodySectionName) (imap.Literal, error) {
+	var b strings.Builder
+
+	if msg.Payload != nil {
+		if len(section.Fields) > 0 {
+			for _, h := range msg.Payload.Headers {
+				for _, field := range section.Fields {
+					if strings.EqualFold(h.Name, field) {
+						b.WriteString(h.Name + ": " + h.Value + "\r\n")
+					}
+				}
+			}
+		} else {
+			for _, h := range msg.Payload.Headers {
+				b.WriteString(h.Name + ": " + h.Value + "\r\n")
+			}
+			b.WriteString("\r\n")
+			if msg.Payload.Body != nil {
+				if decoded, err := base64.StdEncoding.DecodeString(msg.Payload.Body.Data); err == nil {
+					b.Write(decoded)
+				}
+			}
+		}
+	}
+
+	return newLiteral(b.String()), nil
+}
+
+// literal adapts a fixed string to imap.Literal, reporting its original
+// length from Len() regardless of how much has already been read.
+type literal struct {
+	*strings.Reader
+	size int
+}
+
+func newLiteral(s string) *literal {
+	return &literal{Reader: strings.NewReader(s), size: len(s)}
+}
+
+func (l *literal) Len() int { return l.size }
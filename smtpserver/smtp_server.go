@@ -0,0 +1,420 @@
+// smtp_server.go
+//
+// SMTP submission frontend for the Gmail API Emulator. Accepts outbound
+// mail the same way a real Gmail account accepts SMTP submissions from a
+// mail client, parses it into the same MessagePart tree the REST
+// users.messages.send endpoint builds, and appends it to the on-disk
+// dataset so the REST emulator (which polls for changes, see
+// emulator/persist.go) and the IMAP bridge both pick it up.
+// Version: 1.1 - Append re-reads the on-disk dataset before appending,
+// instead of trusting its own possibly-stale in-memory copy
+// Last Updated: 2025-07-26
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package smtpserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// GmailMessage mirrors the emulator/imapserver representation of a
+// transformed message; kept local so this package has no dependency on
+// the emulator binary.
+type GmailMessage struct {
+	Id           string       `json:"id"`
+	ThreadId     string       `json:"threadId"`
+	LabelIds     []string     `json:"labelIds"`
+	Snippet      string       `json:"snippet"`
+	HistoryId    string       `json:"historyId"`
+	InternalDate string       `json:"internalDate"`
+	SizeEstimate int          `json:"sizeEstimate"`
+	Payload      *MessagePart `json:"payload"`
+}
+
+type MessagePart struct {
+	PartId   string        `json:"partId,omitempty"`
+	MimeType string        `json:"mimeType"`
+	Filename string        `json:"filename,omitempty"`
+	Headers  []Header      `json:"headers"`
+	Body     *MessageBody  `json:"body,omitempty"`
+	Parts    []MessagePart `json:"parts,omitempty"`
+}
+
+type MessageBody struct {
+	Size         int    `json:"size"`
+	Data         string `json:"data,omitempty"`
+	AttachmentId string `json:"attachmentId,omitempty"`
+}
+
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Store is the on-disk message set a Session appends newly submitted mail
+// to. It loads gmail_messages.json once at startup and rewrites the whole
+// file after each accepted submission, the same dataset every other
+// package in this repo reads from.
+type Store struct {
+	mu       sync.Mutex
+	path     string
+	messages []*GmailMessage
+	idSeq    uint64
+}
+
+// NewStore loads gmail_messages.json from dataPath.
+func NewStore(dataPath string) (*Store, error) {
+	path := filepath.Join(dataPath, "gmail_messages.json")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read messages file: %w", err)
+	}
+
+	var messages []*GmailMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("unmarshal messages: %w", err)
+	}
+
+	return &Store{path: path, messages: messages}, nil
+}
+
+// Append adds msg to the store and persists the updated dataset to disk.
+// It re-reads the current on-disk dataset first, since the REST emulator
+// keeps its own in-memory copy of the same file and may have written to it
+// since this Store last loaded - appending to our own stale s.messages
+// would silently clobber those writes.
+func (s *Store) Append(msg *GmailMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, err := s.readLocked(); err == nil {
+		s.messages = current
+	}
+
+	s.messages = append(s.messages, msg)
+
+	data, err := json.MarshalIndent(s.messages, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal messages: %w", err)
+	}
+	return ioutil.WriteFile(s.path, data, 0644)
+}
+
+// readLocked re-reads s.path. The caller is responsible for holding s.mu.
+func (s *Store) readLocked() ([]*GmailMessage, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("read messages file: %w", err)
+	}
+
+	var messages []*GmailMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("unmarshal messages: %w", err)
+	}
+	return messages, nil
+}
+
+// nextID mints a new message id, matching the emulator's nextID convention.
+func (s *Store) nextID() string {
+	s.mu.Lock()
+	s.idSeq++
+	seq := s.idSeq
+	s.mu.Unlock()
+	sum := md5.Sum([]byte(fmt.Sprintf("smtp:%d:%d", time.Now().UnixNano(), seq)))
+	return fmt.Sprintf("%x", sum)[:16]
+}
+
+// resolveThreadId threads a submitted message by In-Reply-To/References,
+// mirroring emulator/write.go's resolveThreadId.
+func (s *Store) resolveThreadId(headers []Header, newID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if parent := s.findByMessageID(headerValue(headers, "In-Reply-To")); parent != nil {
+		return parent.ThreadId
+	}
+
+	refs := messageIDRefPattern.FindAllString(headerValue(headers, "References"), -1)
+	for i := len(refs) - 1; i >= 0; i-- {
+		if parent := s.findByMessageID(refs[i]); parent != nil {
+			return parent.ThreadId
+		}
+	}
+
+	return newID
+}
+
+func (s *Store) findByMessageID(messageID string) *GmailMessage {
+	messageID = strings.TrimSpace(messageID)
+	if messageID == "" {
+		return nil
+	}
+	for _, msg := range s.messages {
+		if msg.Payload == nil {
+			continue
+		}
+		if strings.TrimSpace(headerValue(msg.Payload.Headers, "Message-ID")) == messageID {
+			return msg
+		}
+	}
+	return nil
+}
+
+// Backend implements github.com/emersion/go-smtp's Backend interface over
+// a single Store. There is exactly one user, the same test user the rest
+// of the emulator operates against.
+type Backend struct {
+	store *Store
+}
+
+// NewBackend loads gmail_messages.json from dataPath and returns an SMTP
+// backend that appends accepted submissions to it.
+func NewBackend(dataPath string) (*Backend, error) {
+	store, err := NewStore(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{store: store}, nil
+}
+
+func (b *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &Session{store: b.store}, nil
+}
+
+// ListenAndServe starts the SMTP submission server on addr. It blocks
+// until the server stops or returns an error.
+func ListenAndServe(dataPath, addr string) error {
+	be, err := NewBackend(dataPath)
+	if err != nil {
+		return err
+	}
+
+	s := smtp.NewServer(be)
+	s.Addr = addr
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	s.MaxMessageBytes = 25 * 1024 * 1024
+
+	return s.ListenAndServe()
+}
+
+// Session implements smtp.Session for a single submitted message.
+type Session struct {
+	store *Store
+	from  string
+	to    []string
+}
+
+func (s *Session) AuthPlain(username, password string) error { return nil }
+
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+// Data parses the submitted RFC 5322 message and routes it through the
+// same send pipeline as the REST users.messages.send endpoint: build a
+// MessagePart tree, assign an id, resolve its thread, and append it to
+// the dataset tagged SENT.
+func (s *Session) Data(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read message data: %w", err)
+	}
+
+	msg, err := s.buildMessage(data)
+	if err != nil {
+		return fmt.Errorf("parse message: %w", err)
+	}
+
+	return s.store.Append(msg)
+}
+
+func (s *Session) buildMessage(data []byte) (*GmailMessage, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parse raw message: %w", err)
+	}
+
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read message body: %w", err)
+	}
+
+	payload, err := parseMIMEEntity(collectHeaders(textproto.MIMEHeader(m.Header)), m.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, err
+	}
+	numberParts(payload.Parts, "")
+
+	id := s.store.nextID()
+
+	msg := &GmailMessage{
+		Id:           id,
+		LabelIds:     []string{"SENT"},
+		InternalDate: strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+		Payload:      payload,
+	}
+	msg.Snippet = snippetFromPayload(payload)
+	msg.SizeEstimate = estimatePayloadSize(payload)
+	msg.ThreadId = s.store.resolveThreadId(payload.Headers, id)
+
+	return msg, nil
+}
+
+func (s *Session) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *Session) Logout() error { return nil }
+
+func headerValue(headers []Header, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+var messageIDRefPattern = regexp.MustCompile(`<([^<>]+)>`)
+
+// parseMIMEEntity turns one MIME entity - possibly multipart/* - into a
+// MessagePart tree. Mirrors emulator/write.go's parseMIMEEntity.
+func parseMIMEEntity(headers []Header, contentType string, body []byte) (*MessagePart, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		part := &MessagePart{MimeType: mediaType, Headers: headers}
+
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			data, err := ioutil.ReadAll(p)
+			if err != nil {
+				return nil, fmt.Errorf("read mime part: %w", err)
+			}
+
+			sub, err := parseMIMEEntity(collectHeaders(textproto.MIMEHeader(p.Header)), p.Header.Get("Content-Type"), data)
+			if err != nil {
+				return nil, err
+			}
+			sub.Filename = p.FileName()
+			part.Parts = append(part.Parts, *sub)
+		}
+
+		return part, nil
+	}
+
+	return &MessagePart{
+		MimeType: mediaType,
+		Headers:  headers,
+		Body: &MessageBody{
+			Size: len(body),
+			Data: base64.StdEncoding.EncodeToString(body),
+		},
+	}, nil
+}
+
+func collectHeaders(h textproto.MIMEHeader) []Header {
+	headers := make([]Header, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, Header{Name: name, Value: v})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+// numberParts assigns Gmail-style partIds. Mirrors emulator/write.go's
+// numberParts.
+func numberParts(parts []MessagePart, prefix string) {
+	for i := range parts {
+		id := strconv.Itoa(i)
+		if prefix != "" {
+			id = prefix + "." + id
+		}
+		parts[i].PartId = id
+		if len(parts[i].Parts) > 0 {
+			numberParts(parts[i].Parts, id)
+		}
+	}
+}
+
+func snippetFromPayload(part *MessagePart) string {
+	text := strings.Join(strings.Fields(firstPlainText(part)), " ")
+	if len(text) > 150 {
+		text = text[:150]
+	}
+	return text
+}
+
+func firstPlainText(part *MessagePart) string {
+	if part == nil {
+		return ""
+	}
+	if part.MimeType == "text/plain" && part.Body != nil && part.Body.Data != "" {
+		if decoded, err := base64.StdEncoding.DecodeString(part.Body.Data); err == nil {
+			return string(decoded)
+		}
+	}
+	for i := range part.Parts {
+		if s := firstPlainText(&part.Parts[i]); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// estimatePayloadSize sums every part's body size plus a fixed overhead
+// for headers, matching the transformer's SizeEstimate convention.
+func estimatePayloadSize(part *MessagePart) int {
+	size := 512
+	var walk func(p *MessagePart)
+	walk = func(p *MessagePart) {
+		if p.Body != nil {
+			size += p.Body.Size
+		}
+		for i := range p.Parts {
+			walk(&p.Parts[i])
+		}
+	}
+	walk(part)
+	return size
+}
@@ -1,8 +1,8 @@
 // enron_transformer.go
 //
 // Transforms Enron email dataset into Gmail API format for testing
-// Version: 2.0
-// Last Updated: 2025-07-13
+// Version: 2.2 - Multipart MIME payloads: HTML alternative, quoted-reply parts, attachments
+// Last Updated: 2025-07-20
 //
 // Carson Sweet assisted by Claude AI
 // https://www.carsonsweet.com
@@ -16,6 +16,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"log"
 	"os"
@@ -38,6 +39,10 @@ type EnronEmail struct {
 	Subject   string
 	Body      string
 
+	// Threading headers (RFC 5322)
+	InReplyTo  string
+	References []string
+
 	// Enron-specific metadata
 	XFrom     string
 	XTo       string
@@ -74,8 +79,9 @@ type MessagePart struct {
 }
 
 type MessageBody struct {
-	Size int    `json:"size"`
-	Data string `json:"data"`
+	Size         int    `json:"size"`
+	Data         string `json:"data,omitempty"`
+	AttachmentId string `json:"attachmentId,omitempty"`
 }
 
 type Header struct {
@@ -106,14 +112,15 @@ type contact struct {
 
 // GmailTransformer handles the transformation from Enron to Gmail format
 type GmailTransformer struct {
-	baseDate      time.Time
-	timeShift     time.Duration
-	threadCache   map[string]string
-	personaMap    map[string]TestPersona
-	messageIDMap  map[string]string
-	userEmail     string
-	enronUserName string
-	stats         TransformStats
+	baseDate         time.Time
+	timeShift        time.Duration
+	threadAssignment map[string]string // Enron Message-ID -> Gmail ThreadId
+	personaMap       map[string]TestPersona
+	messageIDMap     map[string]string
+	userEmail        string
+	enronUserName    string
+	stats            TransformStats
+	historyStore     *HistoryStore
 }
 
 func NewGmailTransformer(enronUserName, testUserEmail string) *GmailTransformer {
@@ -121,13 +128,14 @@ func NewGmailTransformer(enronUserName, testUserEmail string) *GmailTransformer
 	enronStart := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	return &GmailTransformer{
-		baseDate:      baseDate,
-		timeShift:     baseDate.Sub(enronStart),
-		threadCache:   make(map[string]string),
-		personaMap:    make(map[string]TestPersona),
-		messageIDMap:  make(map[string]string),
-		userEmail:     testUserEmail,
-		enronUserName: enronUserName,
+		baseDate:         baseDate,
+		timeShift:        baseDate.Sub(enronStart),
+		threadAssignment: make(map[string]string),
+		personaMap:       make(map[string]TestPersona),
+		messageIDMap:     make(map[string]string),
+		userEmail:        testUserEmail,
+		enronUserName:    enronUserName,
+		historyStore:     NewHistoryStore(),
 		stats: TransformStats{
 			PersonaMap: make(map[string]TestPersona),
 			Errors:     []string{},
@@ -135,6 +143,12 @@ func NewGmailTransformer(enronUserName, testUserEmail string) *GmailTransformer
 	}
 }
 
+// History returns the transformer's change log, for callers that want to
+// persist it or read the current historyId.
+func (t *GmailTransformer) History() *HistoryStore {
+	return t.historyStore
+}
+
 // LoadEnronEmails loads emails from the Enron dataset
 func LoadEnronEmails(rootPath, username string, limit int) ([]*EnronEmail, error) {
 	emails := []*EnronEmail{}
@@ -269,6 +283,13 @@ func processHeader(email *EnronEmail, header, value string) {
 		email.BCC = parseRecipientList(value)
 	case "Subject":
 		email.Subject = value
+	case "In-Reply-To":
+		ids := parseMessageIdList(value)
+		if len(ids) > 0 {
+			email.InReplyTo = ids[0]
+		}
+	case "References":
+		email.References = parseMessageIdList(value)
 	case "X-From":
 		email.XFrom = cleanEnronAddress(value)
 	case "X-To":
@@ -323,6 +344,19 @@ func parseRecipientList(value string) []string {
 	return recipients
 }
 
+// parseMessageIdList extracts the "<...>" tokens out of an In-Reply-To or
+// References header value, e.g. "<a@x> <b@y>" -> ["a@x", "b@y"].
+func parseMessageIdList(value string) []string {
+	ids := []string{}
+	matches := messageIDPattern.FindAllStringSubmatch(value, -1)
+	for _, m := range matches {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+var messageIDPattern = regexp.MustCompile(`<([^<>]+)>`)
+
 // TransformDataset transforms Enron emails to Gmail format
 func (t *GmailTransformer) TransformDataset(emails []*EnronEmail) ([]*GmailMessage, error) {
 	sort.Slice(emails, func(i, j int) bool {
@@ -330,6 +364,7 @@ func (t *GmailTransformer) TransformDataset(emails []*EnronEmail) ([]*GmailMessa
 	})
 
 	t.buildPersonaMap(emails)
+	t.threadAssignment = t.buildThreadAssignments(emails)
 
 	gmailMessages := make([]*GmailMessage, 0, len(emails))
 
@@ -346,7 +381,11 @@ func (t *GmailTransformer) TransformDataset(emails []*EnronEmail) ([]*GmailMessa
 		t.stats.TotalTransformed++
 	}
 
-	t.stats.ThreadCount = len(t.threadCache)
+	threadIDs := make(map[string]bool)
+	for _, threadID := range t.threadAssignment {
+		threadIDs[threadID] = true
+	}
+	t.stats.ThreadCount = len(threadIDs)
 	t.stats.PersonaMap = t.personaMap
 
 	return gmailMessages, nil
@@ -427,18 +466,15 @@ func (t *GmailTransformer) transformEmail(enron *EnronEmail) (*GmailMessage, err
 	t.messageIDMap[enron.MessageID] = gmailID
 
 	headers := t.transformHeaders(enron)
-	threadID := t.getOrCreateThreadID(enron)
+	threadID := t.threadAssignment[enron.MessageID]
+	if threadID == "" {
+		// Message-ID was empty or missing from the dataset; fall back to a
+		// thread of one rather than dropping the message.
+		threadID = t.generateThreadID(enron.MessageID)
+	}
 	body := t.transformBody(enron.Body)
 
-	payload := &MessagePart{
-		PartId:   "",
-		MimeType: "text/plain",
-		Headers:  headers,
-		Body: &MessageBody{
-			Size: len(body),
-			Data: base64.StdEncoding.EncodeToString([]byte(body)),
-		},
-	}
+	payload, attachmentSize := t.buildPayload(gmailID, headers, body)
 
 	labels := t.inferLabels(enron)
 	shiftedDate := enron.Date.Add(t.timeShift)
@@ -448,15 +484,222 @@ func (t *GmailTransformer) transformEmail(enron *EnronEmail) (*GmailMessage, err
 		ThreadId:     threadID,
 		LabelIds:     labels,
 		Snippet:      t.generateSnippet(body),
-		HistoryId:    fmt.Sprintf("%d", shiftedDate.Unix()),
 		InternalDate: fmt.Sprintf("%d", shiftedDate.UnixMilli()),
-		SizeEstimate: len(enron.Body) + 512,
+		SizeEstimate: len(enron.Body) + 512 + attachmentSize,
 		Payload:      payload,
 	}
 
+	rec := t.historyStore.RecordInsert(gmail.Id, gmail.LabelIds)
+	gmail.HistoryId = fmt.Sprintf("%d", rec.Id)
+
 	return gmail, nil
 }
 
+// buildPayload turns the plain-text transformed body into a Gmail-shaped
+// MessagePart tree: a multipart/alternative (plain + synthesized HTML),
+// wrapped in multipart/mixed alongside a message/rfc822 part for any
+// quoted/forwarded history and a synthetic attachment for a configurable
+// share of messages. When a message has neither, the multipart/alternative
+// part is itself the top-level payload. It returns the attachment's size (0 if none) so the
+// caller can fold it into SizeEstimate.
+func (t *GmailTransformer) buildPayload(gmailID string, headers []Header, body string) (*MessagePart, int) {
+	primary, quoted := splitQuotedBody(body)
+
+	plainPart := MessagePart{
+		MimeType: "text/plain",
+		Headers:  []Header{{Name: "Content-Type", Value: `text/plain; charset="UTF-8"`}},
+		Body: &MessageBody{
+			Size: len(primary),
+			Data: base64.StdEncoding.EncodeToString([]byte(primary)),
+		},
+	}
+
+	html := buildHTMLBody(primary, quoted)
+	htmlPart := MessagePart{
+		MimeType: "text/html",
+		Headers:  []Header{{Name: "Content-Type", Value: `text/html; charset="UTF-8"`}},
+		Body: &MessageBody{
+			Size: len(html),
+			Data: base64.StdEncoding.EncodeToString([]byte(html)),
+		},
+	}
+
+	mixedParts := []MessagePart{
+		{
+			MimeType: "multipart/alternative",
+			Headers:  []Header{{Name: "Content-Type", Value: "multipart/alternative"}},
+			Parts:    []MessagePart{plainPart, htmlPart},
+		},
+	}
+
+	if quoted != "" {
+		mixedParts = append(mixedParts, MessagePart{
+			MimeType: "message/rfc822",
+			Headers:  []Header{{Name: "Content-Type", Value: "message/rfc822"}},
+			Parts: []MessagePart{
+				{
+					MimeType: "text/plain",
+					Headers:  []Header{{Name: "Content-Type", Value: `text/plain; charset="UTF-8"`}},
+					Body: &MessageBody{
+						Size: len(quoted),
+						Data: base64.StdEncoding.EncodeToString([]byte(quoted)),
+					},
+				},
+			},
+		})
+	}
+
+	attachmentSize := 0
+	if attachment, ok := generateAttachment(gmailID); ok {
+		mixedParts = append(mixedParts, attachment)
+		attachmentSize = attachment.Body.Size
+	}
+
+	var payload *MessagePart
+	if len(mixedParts) == 1 {
+		payload = &mixedParts[0]
+		payload.Headers = headers
+	} else {
+		payload = &MessagePart{
+			MimeType: "multipart/mixed",
+			Headers:  headers,
+			Parts:    mixedParts,
+		}
+	}
+
+	numberParts(payload.Parts, "")
+
+	return payload, attachmentSize
+}
+
+// splitQuotedBody separates a forwarded/quoted region (marked by
+// "-----Original Message-----" or "> "-prefixed lines, the same markers
+// generateSnippet already recognizes) from the primary reply text.
+func splitQuotedBody(body string) (primary, quoted string) {
+	lines := strings.Split(body, "\n")
+
+	splitIdx := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.Contains(trimmed, "-----Original Message-----") || strings.HasPrefix(trimmed, ">") {
+			splitIdx = i
+			break
+		}
+	}
+
+	if splitIdx < 0 {
+		return strings.TrimSpace(body), ""
+	}
+
+	primary = strings.TrimSpace(strings.Join(lines[:splitIdx], "\n"))
+	quoted = strings.TrimSpace(strings.Join(lines[splitIdx:], "\n"))
+	return primary, quoted
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>]+`)
+
+// buildHTMLBody synthesizes an HTML alternative: autolinked URLs in the
+// primary text, with any quoted history wrapped in a <blockquote>.
+func buildHTMLBody(primary, quoted string) string {
+	var b strings.Builder
+	b.WriteString("<html><body><div>")
+	b.WriteString(autolinkAndBreak(primary))
+	b.WriteString("</div>")
+
+	if quoted != "" {
+		b.WriteString("<blockquote>")
+		b.WriteString(autolinkAndBreak(quoted))
+		b.WriteString("</blockquote>")
+	}
+
+	b.WriteString("</body></html>")
+	return b.String()
+}
+
+func autolinkAndBreak(text string) string {
+	escaped := html.EscapeString(text)
+	linked := urlPattern.ReplaceAllStringFunc(escaped, func(u string) string {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, u, u)
+	})
+	return strings.ReplaceAll(linked, "\n", "<br>\n")
+}
+
+// numberParts assigns Gmail-style partIds: top-level children are "0",
+// "1", ...; a part's own children are numbered "<parent>.0", "<parent>.1".
+func numberParts(parts []MessagePart, prefix string) {
+	for i := range parts {
+		id := strconv.Itoa(i)
+		if prefix != "" {
+			id = prefix + "." + id
+		}
+		parts[i].PartId = id
+		if len(parts[i].Parts) > 0 {
+			numberParts(parts[i].Parts, id)
+		}
+	}
+}
+
+// syntheticAttachmentKinds are the fixture attachments messages can carry;
+// sizes are realistic enough to exercise size-based query operators.
+var syntheticAttachmentKinds = []struct {
+	filename string
+	mimeType string
+	size     int
+}{
+	{filename: "quarterly_report.pdf", mimeType: "application/pdf", size: 48213},
+	{filename: "chart.png", mimeType: "image/png", size: 21870},
+	{filename: "data_export.csv", mimeType: "text/csv", size: 6104},
+}
+
+// attachmentPercent is the share of messages that get a synthetic attachment.
+const attachmentPercent = 12
+
+// generateAttachment deterministically (hashed from the message's Gmail ID,
+// so reruns are stable) decides whether a message carries a synthetic
+// attachment and, if so, builds its MessagePart.
+func generateAttachment(gmailID string) (MessagePart, bool) {
+	roll := md5.Sum([]byte("attachment-roll:" + gmailID))
+	if int(roll[0])*100/256 >= attachmentPercent {
+		return MessagePart{}, false
+	}
+
+	kind := syntheticAttachmentKinds[int(roll[1])%len(syntheticAttachmentKinds)]
+	data := generateAttachmentBytes(gmailID, kind.size)
+	attachmentID := fmt.Sprintf("%x", md5.Sum([]byte("attachment-id:"+gmailID+":"+kind.filename)))[:16]
+
+	part := MessagePart{
+		MimeType: kind.mimeType,
+		Filename: kind.filename,
+		Headers: []Header{
+			{Name: "Content-Type", Value: fmt.Sprintf("%s; name=%q", kind.mimeType, kind.filename)},
+			{Name: "Content-Disposition", Value: fmt.Sprintf("attachment; filename=%q", kind.filename)},
+		},
+		Body: &MessageBody{
+			Size:         len(data),
+			Data:         base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(data),
+			AttachmentId: attachmentID,
+		},
+	}
+
+	return part, true
+}
+
+// generateAttachmentBytes produces deterministic filler bytes of the
+// requested size, seeded from the message ID so output is stable across runs.
+func generateAttachmentBytes(seed string, size int) []byte {
+	data := make([]byte, size)
+	block := md5.Sum([]byte(seed))
+
+	for i := range data {
+		if i%16 == 0 {
+			block = md5.Sum(block[:])
+		}
+		data[i] = block[i%16]
+	}
+
+	return data
+}
+
 func (t *GmailTransformer) transformHeaders(enron *EnronEmail) []Header {
 	headers := []Header{}
 
@@ -479,6 +722,24 @@ func (t *GmailTransformer) transformHeaders(enron *EnronEmail) []Header {
 		Header{Name: "Message-ID", Value: fmt.Sprintf("<%s@mail.gmail.com>", t.generateGmailID(enron.MessageID))},
 	)
 
+	if enron.InReplyTo != "" {
+		if gmailID, ok := t.messageIDMap[enron.InReplyTo]; ok {
+			headers = append(headers, Header{Name: "In-Reply-To", Value: fmt.Sprintf("<%s@mail.gmail.com>", gmailID)})
+		}
+	}
+
+	if len(enron.References) > 0 {
+		remapped := []string{}
+		for _, ref := range enron.References {
+			if gmailID, ok := t.messageIDMap[ref]; ok {
+				remapped = append(remapped, fmt.Sprintf("<%s@mail.gmail.com>", gmailID))
+			}
+		}
+		if len(remapped) > 0 {
+			headers = append(headers, Header{Name: "References", Value: strings.Join(remapped, " ")})
+		}
+	}
+
 	return headers
 }
 
@@ -513,27 +774,156 @@ func (t *GmailTransformer) transformEmailList(emails []string) string {
 	return strings.Join(transformed, ", ")
 }
 
-func (t *GmailTransformer) getOrCreateThreadID(enron *EnronEmail) string {
-	subject := t.cleanSubjectForThreading(enron.Subject)
+// msgContainer is a JWZ-style container: either a real message or an empty
+// placeholder created because some other message referenced its ID.
+type msgContainer struct {
+	messageID string
+	email     *EnronEmail
+	parent    *msgContainer
+	children  []*msgContainer
+}
 
-	participants := []string{enron.From}
-	participants = append(participants, enron.To...)
-	sort.Strings(participants)
+// buildThreadAssignments implements the JWZ threading algorithm: build an
+// ID-container table keyed by Message-ID, walk each message's References
+// (falling back to In-Reply-To) to link parent->child, then assign every
+// message in a resulting tree the same ThreadId, derived from the tree's
+// root Message-ID. Root containers with no References are additionally
+// grouped by normalized subject so conversations whose headers didn't
+// survive the Enron export still thread together.
+func (t *GmailTransformer) buildThreadAssignments(emails []*EnronEmail) map[string]string {
+	containers := make(map[string]*msgContainer)
+
+	getContainer := func(id string) *msgContainer {
+		if id == "" {
+			return nil
+		}
+		c, ok := containers[id]
+		if !ok {
+			c = &msgContainer{messageID: id}
+			containers[id] = c
+		}
+		return c
+	}
 
-	if len(participants) > 3 {
-		participants = participants[:3]
+	isAncestor := func(c, candidate *msgContainer) bool {
+		for p := c.parent; p != nil; p = p.parent {
+			if p == candidate {
+				return true
+			}
+		}
+		return false
 	}
 
-	threadKey := fmt.Sprintf("%s|%s", subject, strings.Join(participants, ","))
+	link := func(parent, child *msgContainer) {
+		if parent == nil || child == nil || parent == child || child.parent == parent {
+			return
+		}
+		if isAncestor(parent, child) {
+			return // would create a cycle
+		}
+		if child.parent != nil {
+			siblings := child.parent.children
+			for i, s := range siblings {
+				if s == child {
+					child.parent.children = append(siblings[:i], siblings[i+1:]...)
+					break
+				}
+			}
+		}
+		child.parent = parent
+		parent.children = append(parent.children, child)
+	}
 
-	if threadID, exists := t.threadCache[threadKey]; exists {
-		return threadID
+	for _, email := range emails {
+		if email.MessageID == "" {
+			continue
+		}
+
+		c := getContainer(email.MessageID)
+		c.email = email
+
+		refs := append([]string{}, email.References...)
+		if email.InReplyTo != "" {
+			alreadyLast := len(refs) > 0 && refs[len(refs)-1] == email.InReplyTo
+			if !alreadyLast {
+				refs = append(refs, email.InReplyTo)
+			}
+		}
+
+		var prev *msgContainer
+		for _, refID := range refs {
+			if refID == "" || refID == email.MessageID {
+				continue
+			}
+			cur := getContainer(refID)
+			link(prev, cur)
+			prev = cur
+		}
+		link(prev, c)
+	}
+
+	// Collect one root per disjoint tree.
+	seen := make(map[*msgContainer]bool)
+	roots := []*msgContainer{}
+	for _, c := range containers {
+		root := c
+		for root.parent != nil {
+			root = root.parent
+		}
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
 	}
 
-	threadID := t.generateThreadID(threadKey)
-	t.threadCache[threadKey] = threadID
+	// containers (and therefore the range above) iterates in Go's
+	// randomized map order, so without this sort the subject-grouping
+	// pass below would pick a different root as each subject's anchor -
+	// and therefore generate a different ThreadId - on every run over the
+	// identical corpus. Sorting by messageID makes that anchor choice
+	// deterministic; thread membership was already order-independent.
+	sort.Slice(roots, func(i, j int) bool { return roots[i].messageID < roots[j].messageID })
 
-	return threadID
+	assignments := make(map[string]string)
+	var assign func(c *msgContainer, threadID string)
+	assign = func(c *msgContainer, threadID string) {
+		if c.email != nil {
+			assignments[c.email.MessageID] = threadID
+		}
+		for _, child := range c.children {
+			assign(child, threadID)
+		}
+	}
+
+	subjectRoots := make(map[string]*msgContainer)
+
+	for _, root := range roots {
+		hasReferences := root.email != nil && (len(root.email.References) > 0 || root.email.InReplyTo != "")
+		effectiveRoot := root
+
+		if !hasReferences {
+			var subject string
+			switch {
+			case root.email != nil:
+				subject = t.cleanSubjectForThreading(root.email.Subject)
+			case len(root.children) > 0 && root.children[0].email != nil:
+				subject = t.cleanSubjectForThreading(root.children[0].email.Subject)
+			}
+
+			if subject != "" {
+				if existing, ok := subjectRoots[subject]; ok {
+					link(existing, root)
+					effectiveRoot = existing
+				} else {
+					subjectRoots[subject] = root
+				}
+			}
+		}
+
+		assign(effectiveRoot, t.generateThreadID(effectiveRoot.messageID))
+	}
+
+	return assignments
 }
 
 func (t *GmailTransformer) cleanSubjectForThreading(subject string) string {
@@ -771,7 +1161,7 @@ type MessageRef struct {
 }
 
 // GenerateTestData creates all necessary test fixtures
-func GenerateTestData(messages []*GmailMessage, outputDir string) error {
+func GenerateTestData(messages []*GmailMessage, history *HistoryStore, outputDir string) error {
 	// Create output directory
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return fmt.Errorf("create output dir: %w", err)
@@ -787,6 +1177,12 @@ func GenerateTestData(messages []*GmailMessage, outputDir string) error {
 		return fmt.Errorf("write messages: %w", err)
 	}
 
+	// 1b. Save the history log alongside it
+	historyFile := filepath.Join(outputDir, "history.json")
+	if err := history.Save(historyFile); err != nil {
+		return err
+	}
+
 	// 2. Generate message list response
 	messageRefs := make([]MessageRef, len(messages))
 	for i, msg := range messages {
@@ -895,7 +1291,7 @@ func main() {
 	}
 
 	// Save test data
-	if err := GenerateTestData(gmailMessages, *outputDir); err != nil {
+	if err := GenerateTestData(gmailMessages, transformer.History(), *outputDir); err != nil {
 		log.Fatalf("Failed to generate test data: %v", err)
 	}
 
@@ -907,6 +1303,7 @@ func main() {
 	log.Printf("Test data generated in %s\n", *outputDir)
 	log.Printf("Files created:\n")
 	log.Printf("  - gmail_messages.json: Full message data\n")
+	log.Printf("  - history.json: Mutation log for users.history.list\n")
 	log.Printf("  - list_messages_response.json: API list response\n")
 	log.Printf("  - test_metadata.json: Dataset statistics\n")
 	log.Printf("  - transform_stats.json: Transformation details\n")
@@ -0,0 +1,169 @@
+// history.go
+//
+// Monotonic history log for the transformed Gmail dataset, backing
+// users.history.list-style incremental sync.
+// Version: 1.0
+// Last Updated: 2025-07-19
+//
+// Carson Sweet assisted by Claude AI
+// https://www.carsonsweet.com
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// History mutation types, mirroring the "type" field of a real Gmail
+// history record.
+const (
+	HistoryMessageAdded   = "messageAdded"
+	HistoryMessageDeleted = "messageDeleted"
+	HistoryLabelAdded     = "labelAdded"
+	HistoryLabelRemoved   = "labelRemoved"
+)
+
+// HistoryRecord is one entry in the change log: a single mutation applied
+// to a single message, with a strictly increasing Id.
+type HistoryRecord struct {
+	Id        uint64   `json:"id"`
+	Type      string   `json:"type"`
+	MessageId string   `json:"messageId"`
+	LabelIds  []string `json:"labelIds,omitempty"`
+}
+
+// HistoryMutation describes a change to synthesize via GmailTransformer.Apply,
+// e.g. in tests that want to exercise users.history.list without re-running
+// the full transform.
+type HistoryMutation struct {
+	Type      string
+	MessageId string
+	LabelIds  []string
+}
+
+// HistoryStore assigns monotonically increasing historyIds to mutations and
+// keeps the full log in memory, fanning new records out to subscribers the
+// way hydroxide's event loop refreshes incremental state.
+type HistoryStore struct {
+	mu          sync.Mutex
+	nextID      uint64
+	records     []HistoryRecord
+	subscribers []chan HistoryRecord
+}
+
+// NewHistoryStore returns an empty store whose first assigned Id is 1.
+func NewHistoryStore() *HistoryStore {
+	return &HistoryStore{nextID: 1}
+}
+
+func (h *HistoryStore) append(recordType, messageID string, labelIDs []string) HistoryRecord {
+	h.mu.Lock()
+	rec := HistoryRecord{Id: h.nextID, Type: recordType, MessageId: messageID, LabelIds: labelIDs}
+	h.nextID++
+	h.records = append(h.records, rec)
+	subs := append([]chan HistoryRecord{}, h.subscribers...)
+	h.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- rec:
+		default:
+			// Slow subscriber; drop rather than block the transform.
+		}
+	}
+
+	return rec
+}
+
+// RecordInsert logs the initial creation of a message with its starting labels.
+func (h *HistoryStore) RecordInsert(messageID string, labelIDs []string) HistoryRecord {
+	return h.append(HistoryMessageAdded, messageID, labelIDs)
+}
+
+// RecordLabelAdded logs one or more labels being added to a message.
+func (h *HistoryStore) RecordLabelAdded(messageID string, labelIDs []string) HistoryRecord {
+	return h.append(HistoryLabelAdded, messageID, labelIDs)
+}
+
+// RecordLabelRemoved logs one or more labels being removed from a message.
+func (h *HistoryStore) RecordLabelRemoved(messageID string, labelIDs []string) HistoryRecord {
+	return h.append(HistoryLabelRemoved, messageID, labelIDs)
+}
+
+// RecordDelete logs a message being permanently deleted.
+func (h *HistoryStore) RecordDelete(messageID string) HistoryRecord {
+	return h.append(HistoryMessageDeleted, messageID, nil)
+}
+
+// Since returns every record with Id > startHistoryId, in the order they
+// were recorded. Records are not merged or compacted: several changes to
+// one message come back as separate records.
+func (h *HistoryStore) Since(startHistoryId uint64) []HistoryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := []HistoryRecord{}
+	for _, rec := range h.records {
+		if rec.Id > startHistoryId {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// LastID returns the most recently assigned historyId, or 0 if the store is empty.
+func (h *HistoryStore) LastID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.records) == 0 {
+		return 0
+	}
+	return h.records[len(h.records)-1].Id
+}
+
+// Subscribe returns a channel that receives every record appended from this
+// point on, for push-style tests. The channel is buffered; slow readers
+// miss records rather than blocking producers.
+func (h *HistoryStore) Subscribe() <-chan HistoryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan HistoryRecord, 16)
+	h.subscribers = append(h.subscribers, ch)
+	return ch
+}
+
+// Save writes the full history log to path as JSON, alongside gmail_messages.json.
+func (h *HistoryStore) Save(path string) error {
+	h.mu.Lock()
+	data, err := json.MarshalIndent(h.records, "", "  ")
+	h.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("marshal history: %w", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write history: %w", err)
+	}
+	return nil
+}
+
+// Apply synthesizes a mutation against the transformer's history log, for
+// tests that want to simulate label changes or deletes without re-running
+// TransformDataset.
+func (t *GmailTransformer) Apply(mutation HistoryMutation) HistoryRecord {
+	switch mutation.Type {
+	case HistoryLabelAdded:
+		return t.historyStore.RecordLabelAdded(mutation.MessageId, mutation.LabelIds)
+	case HistoryLabelRemoved:
+		return t.historyStore.RecordLabelRemoved(mutation.MessageId, mutation.LabelIds)
+	case HistoryMessageDeleted:
+		return t.historyStore.RecordDelete(mutation.MessageId)
+	default:
+		return t.historyStore.RecordInsert(mutation.MessageId, mutation.LabelIds)
+	}
+}